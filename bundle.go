@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A bundle is a tar file with the encrypted chunks, the encrypted metadata
+// and a plain index of the chunks. The metadata refers to the chunks by their
+// names in the bundle until publish replaces them with the ids of the server.
+const (
+	bundleVersion       = 1
+	bundleMetadataEntry = "metadata"
+	bundleIndexEntry    = "index.json"
+	defaultBundle       = "bundle.sft"
+)
+
+type BundleIndex struct {
+	Format            string        `json:"format"` // "sft_bundle"
+	Version           int           `json:"version"`
+	CreatedAt         time.Time     `json:"created_at"`
+	ChecksumAlgorithm string        `json:"checksum_algorithm"`
+	EmbedChecksums    bool          `json:"embed_checksums"`
+	Chunks            []BundleChunk `json:"chunks"`
+}
+
+type BundleChunk struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"` // of the data in the tar file
+	Size   int64  `json:"size"`
+	Hash   string `json:"encrypted_contents_hash"`
+}
+
+type SealResult struct {
+	Schema            int                 `json:"schema"`
+	Command           string              `json:"command"`
+	Bundle            string              `json:"bundle"`
+	Key               string              `json:"key"` // publish needs it to create the link
+	ChecksumAlgorithm string              `json:"checksum_algorithm"`
+	Files             []EncryptFileResult `json:"files"`
+}
+
+// countingWriter tells where the next entry of a tar file starts.
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+type sealedChunk struct {
+	data       UploadedData
+	plaintext  []byte
+	cipherText []byte
+}
+
+// sealFiles encrypts the files like encrypt does, but writes the chunks and
+// the metadata to a bundle instead of uploading them.
+func sealFiles(ctx context.Context, files []string, options *Options) SealResult {
+	if !isValidChecksumAlgorithm(options.ChecksumAlgorithm) {
+		fatal("Unknown checksum algorithm: %s", options.ChecksumAlgorithm)
+	}
+	if options.Bundle == "" {
+		options.Bundle = defaultBundle
+	}
+	enforcePolicy(files, options)
+	pieces := wholeFiles(files, options)
+	file, err := os.OpenFile(options.Bundle, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		fatal("%s already exists, remove it first or choose another file", options.Bundle)
+	}
+	if err != nil {
+		panic(err)
+	}
+	completed := false
+	defer func() {
+		file.Close()
+		// Never leave a half written bundle behind, it would block the rerun
+		if !completed {
+			os.Remove(options.Bundle)
+		}
+	}()
+	counter := &countingWriter{writer: file}
+	writer := tar.NewWriter(counter)
+	index := BundleIndex{
+		Format:            "sft_bundle",
+		Version:           bundleVersion,
+		CreatedAt:         time.Now().UTC(),
+		ChecksumAlgorithm: options.ChecksumAlgorithm,
+		EmbedChecksums:    options.EmbedChecksums,
+		Chunks:            make([]BundleChunk, 0),
+	}
+	writeEntry := func(name string, data []byte) int64 {
+		err := writer.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: index.CreatedAt,
+		})
+		if err != nil {
+			panic(err)
+		}
+		offset := counter.count
+		_, err = writer.Write(data)
+		if err != nil {
+			panic(err)
+		}
+		return offset
+	}
+
+	sealedFiles := make([]UploadedFile, 0)
+	transferProgress := newTransferProgress("Sealing", "Sealed", totalFileSize(pieces))
+	for _, piece := range pieces {
+		fileProgress := transferProgress.startFile(piece.Name, piece.Size)
+		chunks := make([]UploadedData, 0)
+		checksummer := newChecksummer(piece.Checksum.Algorithm)
+		input, err := os.Open(piece.Path)
+		if err != nil {
+			panic(err)
+		}
+		seal := func(ctx context.Context, i int) sealedChunk {
+			buffer := make([]byte, min(maxChunkSize, piece.Size-int64(i)*maxChunkSize))
+			_, err := input.ReadAt(buffer, int64(i)*maxChunkSize)
+			if err != nil {
+				panic(err)
+			}
+			cipherText, encryptionData := encryptData(buffer)
+			return sealedChunk{UploadedData{"", keyFragment(encryptionData.KeyMaterial)}, buffer, cipherText}
+		}
+		orderedParallel(ctx, activeProfile.Parallelism, numChunks(piece.Size), seal, func(i int, chunk sealedChunk) {
+			checksummer.Write(chunk.plaintext)
+			chunk.data.Uuid = fmt.Sprintf("chunks/%06d", len(index.Chunks)+1)
+			offset := writeEntry(chunk.data.Uuid, chunk.cipherText)
+			index.Chunks = append(index.Chunks, BundleChunk{
+				chunk.data.Uuid,
+				offset,
+				int64(len(chunk.cipherText)),
+				cipherTextHash(chunk.cipherText),
+			})
+			chunks = append(chunks, chunk.data)
+			chunkProgress := fileProgress.startChunk(int64(len(chunk.plaintext)))
+			chunkProgress.done(int64(len(chunk.plaintext)))
+		})
+		input.Close()
+		sealedFiles = append(sealedFiles, UploadedFile{
+			piece.Name,
+			int(piece.Size),
+			chunks,
+			piece.ContentType,
+			checksummer.sums(),
+		})
+		fileProgress.finish()
+	}
+	transferProgress.finish()
+
+	// The checksums stay in the bundle for publish to print, index tells
+	// whether they go into the metadata of the link
+	metadata, err := json.Marshal(Metadata{"", sealedFiles, nil})
+	if err != nil {
+		panic(err)
+	}
+	cipherText, encryptionData := encryptData(metadata)
+	writeEntry(bundleMetadataEntry, cipherText)
+	indexData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	writeEntry(bundleIndexEntry, indexData)
+	err = writer.Close()
+	if err != nil {
+		panic(err)
+	}
+	completed = true
+
+	result := SealResult{
+		Schema:            outputSchemaVersion,
+		Command:           "seal",
+		Bundle:            options.Bundle,
+		Key:               keyFragment(encryptionData.KeyMaterial),
+		ChecksumAlgorithm: options.ChecksumAlgorithm,
+		Files:             make([]EncryptFileResult, 0),
+	}
+	for _, file := range sealedFiles {
+		result.Files = append(result.Files, EncryptFileResult{
+			file.Name,
+			file.Size,
+			file.FileType,
+			len(file.Chunks),
+			file.Checksums[options.ChecksumAlgorithm],
+		})
+	}
+	return result
+}
+
+func printSealResult(result *SealResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Println("Successfully encrypted the file(s) into", result.Bundle)
+	fmt.Println("Key (publish needs it, keep it away from the bundle):")
+	fmt.Println(result.Key)
+	fmt.Println("")
+	printChecksums(result.ChecksumAlgorithm, result.Files)
+}
+
+// readBundle reads the index and the encrypted metadata of a bundle, the
+// chunks are read when they are uploaded.
+func readBundle(file *os.File) (BundleIndex, []byte, error) {
+	index := BundleIndex{}
+	var metadata []byte
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return index, nil, err
+		}
+		switch header.Name {
+		case bundleMetadataEntry:
+			metadata, err = io.ReadAll(reader)
+		case bundleIndexEntry:
+			err = json.NewDecoder(reader).Decode(&index)
+		}
+		if err != nil {
+			return index, nil, err
+		}
+	}
+	if index.Format != "sft_bundle" || metadata == nil {
+		return index, nil, errors.New("not an sft bundle")
+	}
+	if index.Version > bundleVersion {
+		return index, nil, fmt.Errorf("bundle version %d is not supported, please update sft", index.Version)
+	}
+	return index, metadata, nil
+}
+
+// readBundleChunk reads a chunk and checks it against its hash in the index.
+func readBundleChunk(file *os.File, chunk BundleChunk) ([]byte, error) {
+	cipherText := make([]byte, chunk.Size)
+	_, err := file.ReadAt(cipherText, chunk.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if cipherTextHash(cipherText) != chunk.Hash {
+		return nil, fmt.Errorf("%s doesn't match its hash", chunk.Name)
+	}
+	return cipherText, nil
+}
+
+type publishedChunk struct {
+	data UploadedData
+	err  error
+}
+
+// publishBundle uploads the chunks of a bundle as they are, and the metadata
+// with the ids the server gave them. The key of the bundle opens the metadata,
+// the files are never decrypted.
+func publishBundle(ctx context.Context, path string, options *Options) EncryptResult {
+	recipientKey(options)
+	if options.Split {
+		fatal("A bundle can't be split")
+	}
+	checkSeparateKey(options)
+	checkWebhookOptions(options)
+	enforceTransferPolicy(options)
+	loadActiveSigningKey()
+	file, err := os.Open(path)
+	if err != nil {
+		fatal("Could not open the bundle: %v", err)
+	}
+	defer file.Close()
+	index, encryptedMetadata, err := readBundle(file)
+	if err != nil {
+		fatal("Could not read the bundle %s: %v", path, err)
+	}
+	metadata, err := openMetadata(encryptedMetadata, fragmentKey(readKey(options)))
+	if err != nil {
+		fatal("The key doesn't open the bundle %s", path)
+	}
+	// The contents were checked by seal, the policy may have changed since
+	rules := activeContentRules()
+	violations := make([]PolicyViolation, 0)
+	for _, uploadedFile := range metadata.Files {
+		violations = append(violations, rules.checkFile(uploadedFile.Name, int64(uploadedFile.Size))...)
+	}
+	enforceViolations(violations, options)
+	chunks := map[string]BundleChunk{}
+	for _, chunk := range index.Chunks {
+		chunks[chunk.Name] = chunk
+	}
+	options.ChecksumAlgorithm = index.ChecksumAlgorithm
+	// Signed metadata always carries the checksums
+	options.EmbedChecksums = index.EmbedChecksums || signingKey != nil
+
+	uploadSize := UploadSize{}
+	placeholderFiles := make([]UploadedFile, 0)
+	for _, uploadedFile := range metadata.Files {
+		for _, data := range uploadedFile.Chunks {
+			chunk, ok := chunks[data.Uuid]
+			if !ok {
+				fatal("The bundle is damaged, %s is missing", data.Uuid)
+			}
+			uploadSize.Plaintext += chunk.Size - gcmTagSize
+			uploadSize.Overhead += gcmTagSize
+		}
+		placeholder := uploadedFile
+		placeholder.Chunks = make([]UploadedData, len(uploadedFile.Chunks))
+		for i := range placeholder.Chunks {
+			placeholder.Chunks[i] = placeholderChunk
+		}
+		placeholderFiles = append(placeholderFiles, placeholder)
+	}
+	placeholderMetadata, err := json.Marshal(newMetadata(options.Description, metadataFiles(placeholderFiles, options.EmbedChecksums)))
+	if err != nil {
+		panic(err)
+	}
+	uploadSize.Metadata = int64(len(placeholderMetadata)) + gcmTagSize
+	maxSize, fetched := getMaxUploadSize(ctx)
+	checkUploadSize(uploadSize, maxSize, fetched)
+	readPasswordIfNeeded(options)
+
+	transfer := createUploadRequest(ctx, &activeProfile)
+	createdAt := time.Now()
+	emitEvent("transfer_created", map[string]interface{}{"transfer_id": transfer.Uuid})
+	defer deleteTransferOnCancel(ctx, &transfer, options)
+	quota := newUploadQuota(uploadSize)
+	transferProgress := newTransferProgress("Uploading", "Uploaded", uploadSize.Plaintext)
+	uploadedFiles := make([]UploadedFile, 0)
+	for _, uploadedFile := range metadata.Files {
+		fileProgress := transferProgress.startFile(uploadedFile.Name, int64(uploadedFile.Size))
+		sealed := uploadedFile.Chunks
+		upload := func(ctx context.Context, i int) publishedChunk {
+			chunk := chunks[sealed[i].Uuid]
+			cipherText, err := readBundleChunk(file, chunk)
+			if err != nil {
+				// Stopped on this goroutine, where the transfer can be cleaned up
+				return publishedChunk{err: err}
+			}
+			chunkProgress := fileProgress.startChunk(chunk.Size - gcmTagSize)
+			uuid := uploadCipherText(ctx, cipherText, chunk.Hash, &transfer, quota, chunkProgress)
+			chunkProgress.done(chunk.Size - gcmTagSize)
+			return publishedChunk{data: UploadedData{uuid, sealed[i].Secret}}
+		}
+		uploadedFile.Chunks = make([]UploadedData, 0)
+		orderedParallel(ctx, activeProfile.Parallelism, len(sealed), upload, func(i int, chunk publishedChunk) {
+			if chunk.err != nil {
+				discardTransfer(ctx, &transfer)
+				fatal("The bundle is damaged, %v", chunk.err)
+			}
+			uploadedFile.Chunks = append(uploadedFile.Chunks, chunk.data)
+		})
+		uploadedFiles = append(uploadedFiles, uploadedFile)
+		fileProgress.finish()
+	}
+	transferProgress.finish()
+	return completeTransfer(ctx, "publish", &transfer, createdAt, uploadedFiles, "", options)
+}
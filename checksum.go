@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	ChecksumSha256  = "sha256"
+	ChecksumBlake2b = "blake2b" // BLAKE2b-512, as printed by b2sum
+)
+
+// Results of verifying a downloaded file.
+const (
+	ChecksumOk       = "ok"
+	ChecksumMismatch = "mismatch"
+	// A checksum was expected with an algorithm sft can't compute
+	ChecksumUnverified = "unverified"
+)
+
+func isValidChecksumAlgorithm(algorithm string) bool {
+	return algorithm == ChecksumSha256 || algorithm == ChecksumBlake2b
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	if algorithm == ChecksumBlake2b {
+		h, err := blake2b.New512(nil)
+		if err != nil {
+			panic(err)
+		}
+		return h
+	}
+	return sha256.New()
+}
+
+// checksumAlgorithmOf tells the algorithm of a hex checksum by its length.
+func checksumAlgorithmOf(checksum string) string {
+	switch len(checksum) {
+	case sha256.Size * 2:
+		return ChecksumSha256
+	case blake2b.Size * 2:
+		return ChecksumBlake2b
+	}
+	return ""
+}
+
+// Checksummer computes checksums of the data written to it with several
+// algorithms at once.
+type Checksummer struct {
+	hashes map[string]hash.Hash
+}
+
+func newChecksummer(algorithms ...string) *Checksummer {
+	c := &Checksummer{hashes: map[string]hash.Hash{}}
+	for _, algorithm := range algorithms {
+		c.hashes[algorithm] = newChecksumHash(algorithm)
+	}
+	return c
+}
+
+func (c *Checksummer) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (c *Checksummer) sums() map[string]string {
+	sums := map[string]string{}
+	for algorithm, h := range c.hashes {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// FileChecksum is shared by the pieces of a file. The pieces are uploaded in
+// order, so it ends up with the checksum of the whole file.
+type FileChecksum struct {
+	Algorithm string
+	// Also put the checksum of every piece in the encrypted metadata
+	Embed bool
+	file  *Checksummer
+}
+
+func newFileChecksum(algorithm string, embed bool) *FileChecksum {
+	return &FileChecksum{algorithm, embed, newChecksummer(algorithm)}
+}
+
+func (c *FileChecksum) sum() string {
+	return c.file.sums()[c.Algorithm]
+}
+
+// printChecksums prints the checksums in the format of sha256sum and b2sum,
+// so they can be checked with "sha256sum -c".
+func printChecksums(algorithm string, files []EncryptFileResult) {
+	fmt.Printf("Checksums (%s):\n", algorithm)
+	for _, file := range files {
+		fmt.Printf("%s  %s\n", file.Checksum, file.Name)
+	}
+}
+
+// readChecksumFile reads a sha256sum or b2sum file into name -> algorithm
+// -> checksum.
+func readChecksumFile(path string) map[string]map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		fatal("Could not read the checksums: %v", err)
+	}
+	defer file.Close()
+	checksums := map[string]map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 || checksumAlgorithmOf(fields[0]) == "" {
+			continue
+		}
+		// "  name" in text mode, " *name" in binary mode
+		name := filepath.Base(strings.TrimLeft(fields[1], " *"))
+		if checksums[name] == nil {
+			checksums[name] = map[string]string{}
+		}
+		checksums[name][checksumAlgorithmOf(fields[0])] = strings.ToLower(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		fatal("Could not read the checksums: %v", err)
+	}
+	return checksums
+}
+
+// readPublishedChecksums reads the --checksums file, before anything is
+// downloaded so that a wrong path doesn't waste a download.
+func readPublishedChecksums(options *Options) map[string]map[string]string {
+	if options.ChecksumFile == "" {
+		return map[string]map[string]string{}
+	}
+	return readChecksumFile(options.ChecksumFile)
+}
+
+// expectedChecksums merges the checksums of the sender of a file with the
+// published ones for its name.
+func expectedChecksums(name string, sender map[string]string, published map[string]map[string]string) map[string]string {
+	want := map[string]string{}
+	for algorithm, checksum := range sender {
+		want[algorithm] = strings.ToLower(checksum)
+	}
+	for algorithm, checksum := range published[filepath.Base(name)] {
+		want[algorithm] = checksum
+	}
+	return want
+}
+
+// downloadChecksummer hashes a downloaded file with SHA-256 and with the
+// algorithms of the expected checksums.
+func downloadChecksummer(expected map[string]string) *Checksummer {
+	algorithms := []string{ChecksumSha256}
+	for algorithm := range expected {
+		if isValidChecksumAlgorithm(algorithm) && algorithm != ChecksumSha256 {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return newChecksummer(algorithms...)
+}
+
+// verifyChecksums compares the sizes and checksums of the downloaded files
+// with the expected ones, reports the result and writes .sha256 files on
+// request.
+func verifyChecksums(files []DecryptFileResult, expected []map[string]string, options *Options) {
+	for i := range files {
+		file := &files[i]
+		algorithms := make([]string, 0)
+		for algorithm := range expected[i] {
+			algorithms = append(algorithms, algorithm)
+		}
+		sort.Strings(algorithms)
+		mismatch := file.Written != int64(file.Size)
+		unverified := make([]string, 0)
+		for _, algorithm := range algorithms {
+			got, ok := file.Checksums[algorithm]
+			if !ok {
+				unverified = append(unverified, algorithm)
+			} else if got != expected[i][algorithm] {
+				mismatch = true
+			}
+		}
+		switch {
+		case mismatch:
+			file.ChecksumStatus = ChecksumMismatch
+		case len(unverified) > 0:
+			file.ChecksumStatus = ChecksumUnverified
+		case len(algorithms) > 0:
+			file.ChecksumStatus = ChecksumOk
+		}
+		switch {
+		case file.Written != int64(file.Size):
+			fmt.Fprintf(os.Stderr, "%s: size MISMATCH, %d bytes instead of %d\n", file.Path, file.Written, file.Size)
+		case file.ChecksumStatus == ChecksumMismatch:
+			fmt.Fprintf(os.Stderr, "%s: checksum MISMATCH\n", file.Path)
+		case file.ChecksumStatus == ChecksumUnverified:
+			fmt.Fprintf(os.Stderr, "%s: checksum UNVERIFIED, unknown algorithm %s\n", file.Path, strings.Join(unverified, ", "))
+		case file.ChecksumStatus == ChecksumOk:
+			fmt.Fprintf(humanOut, "%s: checksum OK (%s)\n", file.Path, strings.Join(algorithms, ", "))
+		}
+		// A .sha256 file next to a damaged file would vouch for it
+		if options.WriteChecksum && file.ChecksumStatus != ChecksumMismatch {
+			line := fmt.Sprintf("%s  %s\n", file.Checksums[ChecksumSha256], filepath.Base(file.Path))
+			err := os.WriteFile(file.Path+".sha256", []byte(line), 0644)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// exitOnRejectedFiles fails the command after the result was printed when a
+// downloaded file is not what the sender uploaded or failed the scan.
+func exitOnRejectedFiles(files []DecryptFileResult) {
+	for _, file := range files {
+		if file.ChecksumStatus == ChecksumMismatch || file.ChecksumStatus == ChecksumUnverified || (file.ScanStatus != "" && file.ScanStatus != ScanClean) {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = ""
+
+type Command struct {
+	Name    string
+	Summary string
+	// Positional arguments as shown in the usage line, e.g. "<file>..."
+	Arguments string
+	MinArgs   int
+	MaxArgs   int // -1 for no limit
+	// Values offered by the shell completion for the arguments, files if nil
+	ArgumentValues func() []string
+	// Registers the flags of the command, they write into options
+	Flags func(flags *FlagSet, options *Options)
+	Run   func(ctx context.Context, args []string, options *Options)
+}
+
+type FlagSpec struct {
+	Long  string
+	Short string
+	// Placeholder of the value in the help text, empty for boolean flags
+	Value string
+	Usage string
+}
+
+// FlagSet is a flag.FlagSet that knows the long and short name of every flag,
+// which is needed for the help text and the shell completions.
+type FlagSet struct {
+	*flag.FlagSet
+	Specs []FlagSpec
+}
+
+func newFlagSet(name string) *FlagSet {
+	flags := &FlagSet{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+func (f *FlagSet) BoolFlag(p *bool, long string, short string, usage string) {
+	f.BoolVar(p, long, *p, usage)
+	if short != "" {
+		f.BoolVar(p, short, *p, usage)
+	}
+	f.Specs = append(f.Specs, FlagSpec{long, short, "", usage})
+}
+
+func (f *FlagSet) StringFlag(p *string, long string, short string, value string, usage string) {
+	f.StringVar(p, long, *p, usage)
+	if short != "" {
+		f.StringVar(p, short, *p, usage)
+	}
+	f.Specs = append(f.Specs, FlagSpec{long, short, value, usage})
+}
+
+func (f *FlagSet) IntFlag(p *int, long string, short string, value string, usage string) {
+	f.IntVar(p, long, *p, usage)
+	if short != "" {
+		f.IntVar(p, short, *p, usage)
+	}
+	f.Specs = append(f.Specs, FlagSpec{long, short, value, usage})
+}
+
+func (f *FlagSet) DurationFlag(p *time.Duration, long string, short string, value string, usage string) {
+	f.DurationVar(p, long, *p, usage)
+	if short != "" {
+		f.DurationVar(p, short, *p, usage)
+	}
+	f.Specs = append(f.Specs, FlagSpec{long, short, value, usage})
+}
+
+// verbosity counts -v, -vv counts twice.
+type verbosity struct {
+	level *int
+	step  int
+}
+
+func (v verbosity) String() string {
+	return ""
+}
+
+func (v verbosity) Set(value string) error {
+	*v.level += v.step
+	return nil
+}
+
+func (v verbosity) IsBoolFlag() bool {
+	return true
+}
+
+// VerbosityFlag registers -v/--verbose and -vv.
+func (f *FlagSet) VerbosityFlag(p *int, usage string) {
+	f.Var(verbosity{p, 1}, "verbose", usage)
+	f.Var(verbosity{p, 1}, "v", usage)
+	f.Var(verbosity{p, 2}, "vv", usage)
+	f.Specs = append(f.Specs, FlagSpec{"verbose", "v", "", usage})
+}
+
+// stringList collects the values of a flag that can be repeated.
+type stringList struct {
+	values *[]string
+}
+
+func (l stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l stringList) Set(value string) error {
+	*l.values = append(*l.values, value)
+	return nil
+}
+
+// StringListFlag is a string flag that can be given more than once.
+func (f *FlagSet) StringListFlag(p *[]string, long string, short string, value string, usage string) {
+	f.Var(stringList{p}, long, usage)
+	if short != "" {
+		f.Var(stringList{p}, short, usage)
+	}
+	f.Specs = append(f.Specs, FlagSpec{long, short, value, usage})
+}
+
+// parseInterspersed parses flags anywhere between the positional arguments.
+// Everything after a "--" is positional.
+func (f *FlagSet) parseInterspersed(args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for len(args) > 0 {
+		err := f.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		rest := f.Args()
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional, nil
+}
+
+func (f *FlagSet) writeHelp(w io.Writer) {
+	if len(f.Specs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Options:")
+	for _, spec := range f.Specs {
+		names := "    --" + spec.Long
+		if spec.Short != "" {
+			names = "-" + spec.Short + ", --" + spec.Long
+		}
+		if spec.Value != "" {
+			names += " " + spec.Value
+		}
+		fmt.Fprintf(w, "    %-32s %s\n", names, spec.Usage)
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, command := range commands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func printVersion() {
+	v := version
+	if v == "" {
+		v = "(devel)"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+	}
+	fmt.Println("sft", v)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "    sft <command> [options] [arguments]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(w, "    %-12s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Run 'sft help <command>' for the options of a command.")
+	fmt.Fprintln(w, "Other options: -h, --help, --version")
+}
+
+func printCommandHelp(w io.Writer, command *Command) {
+	fmt.Fprintln(w, command.Summary)
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintf(w, "    sft %s [options] %s\n", command.Name, command.Arguments)
+	fmt.Fprintln(w, "")
+	flags := newFlagSet(command.Name)
+	if command.Flags != nil {
+		command.Flags(flags, &Options{})
+	}
+	flags.writeHelp(w)
+}
+
+func usageError(command *Command, format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n\n", a...)
+	if command == nil {
+		printUsage(os.Stderr)
+	} else {
+		printCommandHelp(os.Stderr, command)
+	}
+	os.Exit(1)
+}
+
+// parseCommandLine picks the command and parses its flags. For backwards
+// compatibility flags may also come before the command name, as in
+// "sft -s decrypt <url>".
+func parseCommandLine(args []string) (*Command, []string, Options) {
+	var command *Command
+	position := 0
+	for ; position < len(args); position++ {
+		arg := args[position]
+		if arg == "-h" || arg == "--help" {
+			printUsage(os.Stdout)
+			os.Exit(0)
+		}
+		if arg == "--version" {
+			printVersion()
+			os.Exit(0)
+		}
+		if command = findCommand(arg); command != nil {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") && (position == 0 || !strings.HasPrefix(args[position-1], "-")) {
+			// Neither a flag nor the value of one
+			usageError(nil, "Unknown command: %s", arg)
+		}
+	}
+	if command == nil {
+		usageError(nil, "Missing command")
+	}
+	leading := args[:position]
+	args = args[position:]
+
+	options := Options{Output: OutputText, ChecksumAlgorithm: ChecksumSha256}
+	flags := newFlagSet(command.Name)
+	if command.Flags != nil {
+		command.Flags(flags, &options)
+	}
+	flags.BoolFlag(&options.Help, "help", "h", "show this help")
+	positional, err := flags.parseInterspersed(append(leading, args[1:]...))
+	if err != nil {
+		usageError(command, "%v", err)
+	}
+	if options.Help {
+		printCommandHelp(os.Stdout, command)
+		os.Exit(0)
+	}
+	if len(positional) < command.MinArgs {
+		usageError(command, "Too few arguments")
+	}
+	if command.MaxArgs >= 0 && len(positional) > command.MaxArgs {
+		usageError(command, "Too many arguments")
+	}
+	return command, positional, options
+}
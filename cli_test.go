@@ -0,0 +1,79 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+type testFlags struct {
+	quiet      bool
+	output     string
+	count      int
+	verbosity  int
+	recipients []string
+}
+
+func newTestFlagSet() (*FlagSet, *testFlags) {
+	values := &testFlags{}
+	flags := newFlagSet("test")
+	flags.BoolFlag(&values.quiet, "quiet", "q", "")
+	flags.StringFlag(&values.output, "output", "o", "DIR", "")
+	flags.IntFlag(&values.count, "count", "n", "N", "")
+	flags.VerbosityFlag(&values.verbosity, "")
+	flags.StringListFlag(&values.recipients, "recipient", "r", "KEY", "")
+	return flags, values
+}
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		want       testFlags
+	}{
+		{nil, []string{}, testFlags{}},
+		{[]string{"a", "b"}, []string{"a", "b"}, testFlags{}},
+		{[]string{"-q", "a", "-o", "out", "b"}, []string{"a", "b"}, testFlags{quiet: true, output: "out"}},
+		{[]string{"a", "--output=out", "b", "-n", "3"}, []string{"a", "b"}, testFlags{output: "out", count: 3}},
+		{[]string{"a", "--", "-q", "b"}, []string{"a", "-q", "b"}, testFlags{}},
+		{[]string{"-q", "--", "--", "a"}, []string{"--", "a"}, testFlags{quiet: true}},
+		{[]string{"-", "-q"}, []string{"-"}, testFlags{quiet: true}},
+		{[]string{"-v", "a"}, []string{"a"}, testFlags{verbosity: 1}},
+		{[]string{"-vv", "a"}, []string{"a"}, testFlags{verbosity: 2}},
+		{[]string{"-v", "a", "--verbose"}, []string{"a"}, testFlags{verbosity: 2}},
+		{[]string{"-r", "k1", "a", "--recipient", "k2"}, []string{"a"}, testFlags{recipients: []string{"k1", "k2"}}},
+	}
+	for _, test := range tests {
+		flags, values := newTestFlagSet()
+		positional, err := flags.parseInterspersed(test.args)
+		if err != nil {
+			t.Errorf("parseInterspersed(%q): %v", test.args, err)
+			continue
+		}
+		if !slices.Equal(positional, test.positional) {
+			t.Errorf("parseInterspersed(%q) = %q, want %q", test.args, positional, test.positional)
+		}
+		if values.quiet != test.want.quiet || values.output != test.want.output || values.count != test.want.count ||
+			values.verbosity != test.want.verbosity || !slices.Equal(values.recipients, test.want.recipients) {
+			t.Errorf("parseInterspersed(%q) set %+v, want %+v", test.args, *values, test.want)
+		}
+	}
+}
+
+func TestParseInterspersedErrors(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"a", "--unknown"}, "flag provided but not defined: -unknown"},
+		{[]string{"a", "-o"}, "flag needs an argument: -o"},
+		{[]string{"-n", "three", "a"}, `invalid value "three" for flag -n`},
+	}
+	for _, test := range tests {
+		flags, _ := newTestFlagSet()
+		_, err := flags.parseInterspersed(test.args)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("parseInterspersed(%q): error %v, want %q", test.args, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func printCompletion(shell string) {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		usageError(findCommand("completion"), "Unknown shell: %s", shell)
+	}
+}
+
+func commandFlagSpecs(command *Command) []FlagSpec {
+	flags := newFlagSet(command.Name)
+	if command.Flags != nil {
+		command.Flags(flags, &Options{})
+	}
+	return append(flags.Specs, FlagSpec{"help", "h", "", "show this help"})
+}
+
+func commandNames() []string {
+	names := make([]string, 0)
+	for _, command := range commands {
+		names = append(names, command.Name)
+	}
+	return names
+}
+
+// argumentValues returns the fixed values of the positional arguments, nil
+// means they are files.
+func argumentValues(command *Command) []string {
+	if command.ArgumentValues == nil {
+		return nil
+	}
+	return command.ArgumentValues()
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	b.WriteString("# bash completion for sft, load with: source <(sft completion bash)\n")
+	b.WriteString("_sft() {\n")
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(&b, "        COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(commandNames(), " "))
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n")
+	b.WriteString("    local opts=\"\" values=\"\"\n")
+	b.WriteString("    case \"${COMP_WORDS[1]}\" in\n")
+	for _, command := range commands {
+		opts := make([]string, 0)
+		for _, spec := range commandFlagSpecs(command) {
+			opts = append(opts, "--"+spec.Long)
+			if spec.Short != "" {
+				opts = append(opts, "-"+spec.Short)
+			}
+		}
+		fmt.Fprintf(&b, "        %s) opts=\"%s\"; values=\"%s\" ;;\n",
+			command.Name, strings.Join(opts, " "), strings.Join(argumentValues(command), " "))
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=( $(compgen -W \"$opts\" -- \"$cur\") )\n")
+	b.WriteString("    elif [ -n \"$values\" ]; then\n")
+	b.WriteString("        COMPREPLY=( $(compgen -W \"$values\" -- \"$cur\") )\n")
+	b.WriteString("    else\n")
+	b.WriteString("        COMPREPLY=( $(compgen -f -- \"$cur\") )\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o filenames -F _sft sft\n")
+	return b.String()
+}
+
+func zshEscape(s string) string {
+	s = strings.ReplaceAll(s, "'", "'\\''")
+	s = strings.ReplaceAll(s, "[", "\\[")
+	s = strings.ReplaceAll(s, "]", "\\]")
+	return strings.ReplaceAll(s, ":", "\\:")
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+	b.WriteString("#compdef sft\n")
+	b.WriteString("# zsh completion for sft, save as _sft in a directory of $fpath\n")
+	b.WriteString("_sft() {\n")
+	b.WriteString("    local -a commands\n")
+	b.WriteString("    commands=(\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "        '%s:%s'\n", command.Name, zshEscape(command.Summary))
+	}
+	b.WriteString("    )\n")
+	b.WriteString("    if (( CURRENT == 2 )); then\n")
+	b.WriteString("        _describe 'command' commands\n")
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n")
+	b.WriteString("    shift words\n")
+	b.WriteString("    (( CURRENT-- ))\n")
+	b.WriteString("    case $words[1] in\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "        %s)\n", command.Name)
+		b.WriteString("            _arguments -s \\\n")
+		for _, spec := range commandFlagSpecs(command) {
+			value := ""
+			if spec.Value != "" {
+				value = ":" + zshEscape(strings.Trim(spec.Value, "<>")) + ":"
+			}
+			if spec.Short != "" {
+				fmt.Fprintf(&b, "                '(-%s --%s)'{-%s,--%s}'[%s]%s' \\\n",
+					spec.Short, spec.Long, spec.Short, spec.Long, zshEscape(spec.Usage), value)
+			} else {
+				fmt.Fprintf(&b, "                '--%s[%s]%s' \\\n", spec.Long, zshEscape(spec.Usage), value)
+			}
+		}
+		if values := argumentValues(command); values != nil {
+			fmt.Fprintf(&b, "                '*:argument:(%s)'\n", strings.Join(values, " "))
+		} else {
+			b.WriteString("                '*:file:_files'\n")
+		}
+		b.WriteString("            ;;\n")
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("}\n")
+	b.WriteString("_sft \"$@\"\n")
+	return b.String()
+}
+
+func fishEscape(s string) string {
+	return strings.ReplaceAll(s, "'", "\\'")
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString("# fish completion for sft, save as ~/.config/fish/completions/sft.fish\n")
+	b.WriteString("complete -c sft -f\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "complete -c sft -n __fish_use_subcommand -a %s -d '%s'\n",
+			command.Name, fishEscape(command.Summary))
+	}
+	for _, command := range commands {
+		condition := "'__fish_seen_subcommand_from " + command.Name + "'"
+		for _, spec := range commandFlagSpecs(command) {
+			line := "complete -c sft -n " + condition + " -l " + spec.Long
+			if spec.Short != "" {
+				line += " -s " + spec.Short
+			}
+			if spec.Value != "" {
+				line += " -r"
+			}
+			fmt.Fprintf(&b, "%s -d '%s'\n", line, fishEscape(spec.Usage))
+		}
+		if values := argumentValues(command); values != nil {
+			fmt.Fprintf(&b, "complete -c sft -n %s -a '%s'\n", condition, strings.Join(values, " "))
+		} else {
+			fmt.Fprintf(&b, "complete -c sft -n %s -F\n", condition)
+		}
+	}
+	return b.String()
+}
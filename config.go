@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultBaseUrl = "https://filetransfer.kpn.com"
+
+// Profile holds the settings for one server. Empty fields fall back to the
+// built in defaults.
+type Profile struct {
+	BaseUrl          string    `toml:"base_url"`
+	DeleteAfter      string    `toml:"delete_after"`
+	DeleteAfterCount int       `toml:"delete_after_count"`
+	Parallelism      int       `toml:"parallelism"`
+	Proxy            string    `toml:"proxy"`
+	OutputDir        string    `toml:"output_dir"`
+	Identity         string    `toml:"identity"`
+	SignKey          string    `toml:"sign_key"`
+	Trust            []string  `toml:"trust"`
+	Webhooks         []Webhook `toml:"webhooks"`
+	// Scan downloaded files with a command and/or clamd
+	ScanCommand   string `toml:"scan_command"`
+	Clamd         string `toml:"clamd"`
+	QuarantineDir string `toml:"quarantine_dir"`
+}
+
+type Config struct {
+	DefaultProfile string             `toml:"default_profile"`
+	Profiles       map[string]Profile `toml:"profiles"`
+	ContentPolicy  ContentPolicy      `toml:"content_policy"`
+}
+
+var defaultProfile = Profile{
+	BaseUrl:          defaultBaseUrl,
+	DeleteAfter:      "7d",
+	DeleteAfterCount: 2,
+	Parallelism:      1,
+}
+
+// The loaded config file and the profile the command runs with, after
+// environment variables and flags have been applied.
+var config Config
+var activeProfile = defaultProfile
+
+// configError is the error of resolveProfile. Only doctor runs despite it, to
+// report it with the other checks.
+var configError error
+
+// configPath returns $SFT_CONFIG or $XDG_CONFIG_HOME/sft/config.toml.
+func configPath() string {
+	if path := os.Getenv("SFT_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sft", "config.toml")
+}
+
+func loadConfig(path string) (Config, error) {
+	loaded := Config{}
+	if path == "" {
+		return loaded, nil
+	}
+	_, err := toml.DecodeFile(path, &loaded)
+	if os.IsNotExist(err) {
+		return loaded, nil
+	}
+	if err != nil {
+		return loaded, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := checkContentPolicy(&loaded.ContentPolicy); err != nil {
+		return loaded, fmt.Errorf("%s: content_policy: %w", path, err)
+	}
+	for name, profile := range loaded.Profiles {
+		if profile.BaseUrl != "" {
+			if _, err := url.ParseRequestURI(profile.BaseUrl); err != nil {
+				return loaded, fmt.Errorf("%s: profile %s: invalid base_url: %w", path, name, err)
+			}
+		}
+		for _, webhook := range profile.Webhooks {
+			if err := checkWebhook(&webhook); err != nil {
+				return loaded, fmt.Errorf("%s: profile %s: %w", path, name, err)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// mergeProfile overwrites the fields of base that are set in override.
+func mergeProfile(base Profile, override Profile) Profile {
+	if override.BaseUrl != "" {
+		base.BaseUrl = strings.TrimSuffix(override.BaseUrl, "/")
+	}
+	if override.DeleteAfter != "" {
+		base.DeleteAfter = override.DeleteAfter
+	}
+	if override.DeleteAfterCount > 0 {
+		base.DeleteAfterCount = override.DeleteAfterCount
+	}
+	if override.Parallelism > 0 {
+		base.Parallelism = override.Parallelism
+	}
+	if override.Proxy != "" {
+		base.Proxy = override.Proxy
+	}
+	if override.OutputDir != "" {
+		base.OutputDir = override.OutputDir
+	}
+	if override.Identity != "" {
+		base.Identity = override.Identity
+	}
+	if override.SignKey != "" {
+		base.SignKey = override.SignKey
+	}
+	if len(override.Trust) > 0 {
+		base.Trust = override.Trust
+	}
+	if len(override.Webhooks) > 0 {
+		base.Webhooks = override.Webhooks
+	}
+	if override.ScanCommand != "" {
+		base.ScanCommand = override.ScanCommand
+	}
+	if override.Clamd != "" {
+		base.Clamd = override.Clamd
+	}
+	if override.QuarantineDir != "" {
+		base.QuarantineDir = override.QuarantineDir
+	}
+	return base
+}
+
+func profileFromEnvironment() (Profile, error) {
+	profile := Profile{
+		BaseUrl:       os.Getenv("SFT_BASE_URL"),
+		DeleteAfter:   os.Getenv("SFT_DELETE_AFTER"),
+		Proxy:         os.Getenv("SFT_PROXY"),
+		OutputDir:     os.Getenv("SFT_OUTPUT_DIR"),
+		Identity:      os.Getenv("SFT_IDENTITY"),
+		SignKey:       os.Getenv("SFT_SIGN_KEY"),
+		ScanCommand:   os.Getenv("SFT_SCAN_COMMAND"),
+		Clamd:         os.Getenv("SFT_CLAMD"),
+		QuarantineDir: os.Getenv("SFT_QUARANTINE_DIR"),
+	}
+	if value := os.Getenv("SFT_TRUST"); value != "" {
+		profile.Trust = strings.Split(value, ",")
+	}
+	var err error
+	if value := os.Getenv("SFT_DELETE_AFTER_COUNT"); value != "" {
+		profile.DeleteAfterCount, err = strconv.Atoi(value)
+		if err != nil {
+			return profile, fmt.Errorf("SFT_DELETE_AFTER_COUNT: %w", err)
+		}
+	}
+	if value := os.Getenv("SFT_PARALLELISM"); value != "" {
+		profile.Parallelism, err = strconv.Atoi(value)
+		if err != nil {
+			return profile, fmt.Errorf("SFT_PARALLELISM: %w", err)
+		}
+	}
+	return profile, nil
+}
+
+// resolveProfile builds the active profile from, in increasing order of
+// precedence, the defaults, the selected profile of the config file, the
+// environment and the command line flags.
+func resolveProfile(options *Options) error {
+	var err error
+	config, err = loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	if err := loadOrgPolicy(); err != nil {
+		return err
+	}
+
+	name := profileName(options)
+	profile := applyTransferDefaults(defaultProfile)
+	if name != "" {
+		fileProfile, ok := config.Profiles[name]
+		if !ok {
+			return fmt.Errorf("unknown profile: %s", name)
+		}
+		profile = mergeProfile(profile, fileProfile)
+	}
+
+	environment, err := profileFromEnvironment()
+	if err != nil {
+		return err
+	}
+	profile = mergeProfile(profile, environment)
+	profile = mergeProfile(profile, options.ProfileFlags)
+	if profile.OutputDir != "" {
+		profile.OutputDir = expandHome(profile.OutputDir)
+	}
+	if profile.Identity != "" {
+		profile.Identity = expandHome(profile.Identity)
+	}
+	if profile.SignKey != "" {
+		profile.SignKey = expandHome(profile.SignKey)
+	}
+	if profile.QuarantineDir != "" {
+		profile.QuarantineDir = expandHome(profile.QuarantineDir)
+	}
+	activeProfile = profile
+	return configureProxy(profile.Proxy)
+}
+
+// profileName returns the profile of --profile, $SFT_PROFILE or the
+// default_profile of the config file, "" for none.
+func profileName(options *Options) string {
+	if options.Profile != "" {
+		return options.Profile
+	}
+	if name := os.Getenv("SFT_PROFILE"); name != "" {
+		return name
+	}
+	return config.DefaultProfile
+}
+
+// configureProxy makes every request go through proxy, otherwise the usual
+// HTTPS_PROXY / NO_PROXY environment variables apply.
+func configureProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %s: %w", proxy, err)
+	}
+	http.DefaultTransport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+	return nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// apiUrl returns the address of an API endpoint of the active server.
+func apiUrl(endpoint string) string {
+	return activeProfile.BaseUrl + "/api/v1/" + endpoint
+}
+
+func downloadPageUrl() string {
+	return activeProfile.BaseUrl + "/download/"
+}
+
+// knownBaseUrls lists the servers of the active profile, the default server
+// and every profile of the config file.
+func knownBaseUrls() []string {
+	baseUrls := []string{activeProfile.BaseUrl, defaultBaseUrl}
+	for _, profile := range config.Profiles {
+		if profile.BaseUrl != "" {
+			baseUrls = append(baseUrls, strings.TrimSuffix(profile.BaseUrl, "/"))
+		}
+	}
+	return baseUrls
+}
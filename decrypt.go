@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/base64"
@@ -39,50 +40,115 @@ type FileInfo struct {
 	Size           int
 	FileType       string
 	Chunks         []UploadedData
+	Checksums      map[string]string
 }
 
-func decryptFromUrl(url string, options *Options) {
-	token, key := parseUrl(url)
-	transferInfo := initiateDownloadRequest(token)
+type DownloadedFile struct {
+	Path      string
+	Checksums map[string]string
+	Written   int64
+}
+
+func decryptFromUrl(ctx context.Context, url string, options *Options) DecryptResult {
+	checkWebhookOptions(options)
+	checkScanCommand()
+	published := readPublishedChecksums(options)
+	baseUrl, token, key := parseUrl(url)
+	// Talk to the server the link points to, not necessarily the one of the profile
+	activeProfile.BaseUrl = baseUrl
+	checkAllowedServer(baseUrl)
+	transferInfo := initiateDownloadRequest(ctx, token)
 	printBasicInfo(&transferInfo)
-	metadata := downloadMetadata(&transferInfo, key)
-	fileInfo := validateFiles(metadata.Files, transferInfo.DownloadToken)
+	metadata := downloadMetadata(ctx, &transferInfo, key)
+	signer := verifySignature(&metadata)
+	fileInfo := validateFiles(ctx, metadata.Files, transferInfo.DownloadToken)
+	result := DecryptResult{
+		Schema:      outputSchemaVersion,
+		Command:     "decrypt",
+		TransferId:  token,
+		Transfer:    transferInfo.Transfer,
+		Description: metadata.Description,
+		Downloaded:  !options.Show,
+		Signer:      signer,
+	}
 	if options.Show {
 		printFiles(metadata.Description, fileInfo)
-		return
+		result.Files = decryptFileResults(fileInfo, nil)
+		return result
+	}
+	expected := make([]map[string]string, 0)
+	for _, info := range fileInfo {
+		expected = append(expected, expectedChecksums(info.Name, info.Checksums, published))
+	}
+	downloaded := downloadFiles(ctx, fileInfo, expected, transferInfo.DownloadToken)
+	fmt.Fprintln(humanOut, "Successfully downloaded all file(s).")
+	result.Files = decryptFileResults(fileInfo, downloaded)
+	verifyChecksums(result.Files, expected, options)
+	scanFiles(ctx, result.Files, &ScanContext{token, metadata.Description, signer})
+	notifyDownload(ctx, []string{token}, result.Files, options)
+	return result
+}
+
+func decryptFileResults(fileInfo []FileInfo, downloaded []DownloadedFile) []DecryptFileResult {
+	results := make([]DecryptFileResult, 0)
+	for i, info := range fileInfo {
+		fileResult := DecryptFileResult{
+			Name:               info.Name,
+			Size:               info.Size,
+			ContentType:        info.FileType,
+			Chunks:             len(info.Chunks),
+			DownloadCount:      info.DownloadCount,
+			RemainingDownloads: info.RemainingCount,
+		}
+		if downloaded != nil {
+			fileResult.Path = downloaded[i].Path
+			fileResult.Checksums = downloaded[i].Checksums
+			fileResult.Written = downloaded[i].Written
+		}
+		results = append(results, fileResult)
 	}
-	downloadFiles(fileInfo, transferInfo.DownloadToken)
-	fmt.Println("Successfully downloaded all file(s).")
+	return results
 }
 
-func parseUrl(url string) (string, []byte) {
-	const prefix = "https://filetransfer.kpn.com/download/"
-	if !strings.HasPrefix(url, prefix) {
-		panic("Url expected to be in the format of https://filetransfer.kpn.com/download/<uuid>#<base64key>")
+// parseUrl accepts download links of every server known from the config file
+// and returns the base url of the server, the transfer id and the key.
+func parseUrl(url string) (string, string, []byte) {
+	baseUrl := ""
+	for _, known := range knownBaseUrls() {
+		if strings.HasPrefix(url, known+"/download/") {
+			baseUrl = known
+			break
+		}
 	}
-	url = url[len(prefix):]
+	if baseUrl == "" || !strings.Contains(url, "#") {
+		panic("Url expected to be in the format of " + downloadPageUrl() + "<uuid>#<base64key>")
+	}
+	url = url[len(baseUrl+"/download/"):]
 	data := strings.SplitN(url, "#", 2)
 	uuid, base64key := data[0], data[1]
+	if isWrappedFragment(base64key) {
+		base64key = unwrapFragment(base64key)
+	}
 	base64key = strings.ReplaceAll(base64key, ".", "=")
 	key := make([]byte, base64.URLEncoding.DecodedLen(len(base64key)))
 	n, err := base64.URLEncoding.Decode(key, []byte(base64key))
 	if err != nil {
-		fmt.Println("Please double check the url. Missing dot at the end?")
+		fmt.Fprintln(humanOut, "Please double check the url. Missing dot at the end?")
 		panic(err)
 	}
 	key = key[:n]
-	return uuid, key
+	return baseUrl, uuid, key
 }
 
 func printFiles(description string, fileInfo []FileInfo) {
-	fmt.Println("\nDescription: ", description)
-	fmt.Println("")
+	fmt.Fprintln(humanOut, "\nDescription: ", description)
+	fmt.Fprintln(humanOut, "")
 	if len(fileInfo) == 0 {
-		fmt.Println("No files detected.")
+		fmt.Fprintln(humanOut, "No files detected.")
 		return
 	}
 	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
+	t.SetOutputMirror(humanOut)
 	t.SetTitle("Files")
 	t.AppendHeader(table.Row{"#", "Name", "Downloads", "Size (bytes)", "FileType"})
 	for i, info := range fileInfo {
@@ -91,71 +157,76 @@ func printFiles(description string, fileInfo []FileInfo) {
 	t.Render()
 }
 
-func initiateDownloadRequest(token string) DownloadRequestResponse {
-	const url = "https://filetransfer.kpn.com/api/v1/download/request/"
-	downloadRequest := DownloadRequest{
-		token,
-	}
-	downloadRequestJson, err := json.Marshal(downloadRequest)
+func initiateDownloadRequest(ctx context.Context, token string) DownloadRequestResponse {
+	downloadResponse, err := requestDownload(ctx, token)
 	if err != nil {
 		panic(err)
 	}
+	return downloadResponse
+}
 
-	response, err := http.Post(url, "application/json", bytes.NewBuffer(downloadRequestJson))
+// requestDownload asks for a download token. The error is a *HttpStatusError
+// when the server refused, e.g. because the transfer expired.
+func requestDownload(ctx context.Context, token string) (DownloadRequestResponse, error) {
+	url := apiUrl("download/request/")
+	downloadResponse := DownloadRequestResponse{}
+	downloadRequest := DownloadRequest{
+		token,
+	}
+	downloadRequestJson, err := json.Marshal(downloadRequest)
 	if err != nil {
-		panic(err)
+		return downloadResponse, err
 	}
-	defer response.Body.Close()
 
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		panic("Download request failed")
-	}
-	responseBody, err := io.ReadAll(response.Body)
+	responseBody, err := doWithRetry(ctx, "Download request", singleAttemptPolicy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(downloadRequestJson))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return request, nil
+	})
 	if err != nil {
-		panic(err)
+		return downloadResponse, err
 	}
-	downloadResponse := DownloadRequestResponse{}
 	err = json.Unmarshal(responseBody, &downloadResponse)
-	if err != nil {
-		panic(err)
-	}
-	return downloadResponse
+	return downloadResponse, err
 }
 
 func printBasicInfo(transferInfo *DownloadRequestResponse) {
-	fmt.Println("Created at: ", transferInfo.Transfer.CreatedAt)
-	fmt.Println("Delete after: ", transferInfo.Transfer.DeleteAfter)
-	fmt.Println("Expires in: ", transferInfo.Transfer.ExpiresIn)
-	fmt.Println("Has password: ", transferInfo.Transfer.HasPassword)
-	fmt.Println("")
+	fmt.Fprintln(humanOut, "Created at: ", transferInfo.Transfer.CreatedAt)
+	fmt.Fprintln(humanOut, "Delete after: ", transferInfo.Transfer.DeleteAfter)
+	fmt.Fprintln(humanOut, "Expires in: ", transferInfo.Transfer.ExpiresIn)
+	fmt.Fprintln(humanOut, "Has password: ", transferInfo.Transfer.HasPassword)
+	fmt.Fprintln(humanOut, "")
 }
 
-func downloadMetadata(transferInfo *DownloadRequestResponse, key []byte) Metadata {
-	const url = "https://filetransfer.kpn.com/api/v1/download/metadata/"
-	request, err := http.NewRequest("GET", url, nil)
+func downloadMetadata(ctx context.Context, transferInfo *DownloadRequestResponse, key []byte) Metadata {
+	url := apiUrl("download/metadata/")
+	responseBody, err := doWithRetry(ctx, "Metadata download", requestRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Download-Token", transferInfo.DownloadToken)
+		return request, nil
+	})
 	if err != nil {
 		panic(err)
 	}
-	request.Header.Set("Download-Token", transferInfo.DownloadToken)
+	return decodeMetadata(responseBody, key)
+}
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		panic(err)
-	}
-	defer response.Body.Close()
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		panic("Metadata download failed")
-	}
-	responseBody, err := io.ReadAll(response.Body)
+func decodeMetadata(cipherText []byte, keyMaterial []byte) Metadata {
+	metadata, err := openMetadata(cipherText, keyMaterial)
 	if err != nil {
 		panic(err)
 	}
-	return decodeMetadata(responseBody, key)
+	return metadata
 }
 
-func decodeMetadata(cipherText []byte, keyMaterial []byte) Metadata {
+// openMetadata decrypts metadata, failing with a wrong key.
+func openMetadata(cipherText []byte, keyMaterial []byte) (Metadata, error) {
 	key, iv := keysFromKeyMaterial(keyMaterial)
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -170,15 +241,12 @@ func decodeMetadata(cipherText []byte, keyMaterial []byte) Metadata {
 
 	plaintext, err := aesgcm.Open(nil, iv, cipherText, add_data)
 	if err != nil {
-		panic(err)
+		return Metadata{}, err
 	}
 
 	metadata := Metadata{}
 	err = json.Unmarshal(plaintext, &metadata)
-	if err != nil {
-		panic(err)
-	}
-	return metadata
+	return metadata, err
 }
 
 type ValidateRequest struct {
@@ -193,8 +261,8 @@ type ValidateResponse struct {
 	RemainingCount int    `json:"remaining_downloads"`
 }
 
-func validateFiles(files []UploadedFile, token string) []FileInfo {
-	validateResponse := doValidateRequest(files, token)
+func validateFiles(ctx context.Context, files []UploadedFile, token string) []FileInfo {
+	validateResponse := doValidateRequest(ctx, files, token)
 	// chunk_uuid -> position in files list
 	helper := map[string]int{}
 	for i, file := range files {
@@ -211,6 +279,7 @@ func validateFiles(files []UploadedFile, token string) []FileInfo {
 			file.Size,
 			file.FileType,
 			file.Chunks,
+			file.Checksums,
 		}
 	}
 	fileInfo := make([]FileInfo, 0)
@@ -220,8 +289,8 @@ func validateFiles(files []UploadedFile, token string) []FileInfo {
 	return fileInfo
 }
 
-func doValidateRequest(files []UploadedFile, token string) []ValidateResponse {
-	const url = "https://filetransfer.kpn.com/api/v1/download/files/validate/"
+func doValidateRequest(ctx context.Context, files []UploadedFile, token string) []ValidateResponse {
+	url := apiUrl("download/files/validate/")
 	uuidsToSend := make([]string, 0)
 	for _, file := range files {
 		uuidsToSend = append(uuidsToSend, file.Chunks[0].Uuid)
@@ -235,17 +304,14 @@ func doValidateRequest(files []UploadedFile, token string) []ValidateResponse {
 		panic(err)
 	}
 
-	response, err := http.Post(url, "application/json", bytes.NewBuffer(validateRequestJson))
-	if err != nil {
-		panic(err)
-	}
-	defer response.Body.Close()
-
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		panic("Download request failed")
-	}
-	responseBody, err := io.ReadAll(response.Body)
+	responseBody, err := doWithRetry(ctx, "Validate", requestRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(validateRequestJson))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return request, nil
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -257,28 +323,71 @@ func doValidateRequest(files []UploadedFile, token string) []ValidateResponse {
 	return validateResponse
 }
 
-func downloadFiles(fileInfo []FileInfo, token string) {
+func downloadFiles(ctx context.Context, fileInfo []FileInfo, expected []map[string]string, token string) []DownloadedFile {
+	totalSize := int64(0)
 	for _, file := range fileInfo {
-		downloadFile(&file, token)
+		totalSize += int64(file.Size)
 	}
-	finalizeDownload(fileInfo, token) // ignore return value
+	if activeProfile.OutputDir != "" {
+		err := os.MkdirAll(activeProfile.OutputDir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	transferProgress := newTransferProgress("Downloading", "Downloaded", totalSize)
+	downloaded := make([]DownloadedFile, 0)
+	for i, file := range fileInfo {
+		downloaded = append(downloaded, downloadFile(ctx, &file, expected[i], token, transferProgress))
+	}
+	transferProgress.finish()
+	finalizeDownload(ctx, fileInfo, token) // ignore return value
+	return downloaded
 }
 
-func downloadFile(fileInfo *FileInfo, token string) {
-	fmt.Println("Downloading ", fileInfo.Name)
-	target := findNameForFile(fileInfo.Name)
-	fmt.Println("Saving to ", target)
+func downloadFile(ctx context.Context, fileInfo *FileInfo, expected map[string]string, token string, transferProgress *TransferProgress) DownloadedFile {
+	// The name comes from the sender, never let it point outside the output directory
+	name := filepath.Join(activeProfile.OutputDir, filepath.Base(fileInfo.Name))
+	target := findNameForFile(name)
+	if target != name {
+		printStatus("Saving %s as %s", fileInfo.Name, target)
+	}
+	fileProgress := transferProgress.startFile(target, int64(fileInfo.Size))
 	f, err := os.Create(target)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
-	for _, chunk := range fileInfo.Chunks {
-		data := downloadChunk(&chunk, token)
-		f.Write(data)
-		fmt.Print(".")
-	}
-	fmt.Print("\n\n")
+	completed := false
+	defer func() {
+		f.Close()
+		// Never leave a half written file behind
+		if !completed {
+			os.Remove(target)
+		}
+	}()
+	checksummer := downloadChecksummer(expected)
+	counter := &countingWriter{writer: f}
+	writeChunks(ctx, fileInfo, token, fileProgress, io.MultiWriter(counter, checksummer))
+	completed = true
+	fileProgress.finish()
+	return DownloadedFile{target, checksummer.sums(), counter.count}
+}
+
+// writeChunks downloads the chunks of a file and writes them to w in order.
+func writeChunks(ctx context.Context, fileInfo *FileInfo, token string, fileProgress *FileProgress, w io.Writer) {
+	download := func(ctx context.Context, i int) []byte {
+		// Only an estimate for the progress, the sender decides the chunk size
+		chunkSize := min(int64(fileInfo.Size)-int64(i)*maxChunkSize, maxChunkSize)
+		chunkProgress := fileProgress.startChunk(max(chunkSize, 1))
+		data := downloadChunk(ctx, &fileInfo.Chunks[i], token, chunkProgress)
+		chunkProgress.done(int64(len(data)))
+		return data
+	}
+	orderedParallel(ctx, activeProfile.Parallelism, len(fileInfo.Chunks), download, func(i int, data []byte) {
+		_, err := w.Write(data)
+		if err != nil {
+			panic(err)
+		}
+	})
 }
 
 func findNameForFile(name string) string {
@@ -300,24 +409,19 @@ func findNameForFile(name string) string {
 	return targetName
 }
 
-func downloadChunk(chunk *UploadedData, token string) []byte {
-	const url = "https://filetransfer.kpn.com/api/v1/download/file/"
-	request, err := http.NewRequest("GET", url+chunk.Uuid+"/", nil)
-	if err != nil {
-		panic(err)
-	}
-	request.Header.Set("Download-Token", token)
-
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		panic(err)
+func downloadChunk(ctx context.Context, chunk *UploadedData, token string, chunkProgress *ChunkProgress) []byte {
+	url := apiUrl("download/file/")
+	countBody := func(body io.Reader) io.Reader {
+		return chunkProgress.reader(body)
 	}
-	defer response.Body.Close()
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		panic("File download failed")
-	}
-	responseBody, err := io.ReadAll(response.Body)
+	responseBody, err := doWithRetryReading(ctx, "File download", chunkRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", url+chunk.Uuid+"/", nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Download-Token", token)
+		return request, nil
+	}, countBody)
 	if err != nil {
 		panic(err)
 	}
@@ -326,7 +430,7 @@ func downloadChunk(chunk *UploadedData, token string) []byte {
 	key := make([]byte, base64.URLEncoding.DecodedLen(len(base64key)))
 	n, err := base64.URLEncoding.Decode(key, []byte(base64key))
 	if err != nil {
-		fmt.Println("Wrong key in metadata")
+		fmt.Fprintln(humanOut, "Wrong key in metadata")
 		panic(err)
 	}
 	key = key[:n]
@@ -335,24 +439,28 @@ func downloadChunk(chunk *UploadedData, token string) []byte {
 }
 
 func decodeChunk(cipherText []byte, keyMaterial []byte) []byte {
-	key, iv := keysFromKeyMaterial(keyMaterial)
-	block, err := aes.NewCipher(key)
+	plaintext, err := openChunk(cipherText, keyMaterial)
 	if err != nil {
 		panic(err)
 	}
+	return plaintext
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+// openChunk decrypts a chunk, failing when it was changed or the key is wrong.
+func openChunk(cipherText []byte, keyMaterial []byte) ([]byte, error) {
+	key, iv := keysFromKeyMaterial(keyMaterial)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		panic(err)
 	}
-	add_data := make([]byte, 1)
 
-	plaintext, err := aesgcm.Open(nil, iv, cipherText, add_data)
+	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		panic(err)
 	}
+	add_data := make([]byte, 1)
 
-	return plaintext
+	return aesgcm.Open(nil, iv, cipherText, add_data)
 }
 
 type FinalizeRequest struct {
@@ -364,8 +472,8 @@ type FinalizeResponse struct {
 	Uuids []ValidateResponse `json:"files"`
 }
 
-func finalizeDownload(fileInfo []FileInfo, token string) FinalizeResponse {
-	const url = "https://filetransfer.kpn.com/api/v1/download/files/success/"
+func finalizeDownload(ctx context.Context, fileInfo []FileInfo, token string) FinalizeResponse {
+	url := apiUrl("download/files/success/")
 	uuidsToSend := make([]string, 0)
 	for _, file := range fileInfo {
 		for _, chunk := range file.Chunks {
@@ -380,7 +488,7 @@ func finalizeDownload(fileInfo []FileInfo, token string) FinalizeResponse {
 		panic(err)
 	}
 
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(finalizeRequestJson))
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(finalizeRequestJson))
 	if err != nil {
 		panic(err)
 	}
@@ -395,10 +503,8 @@ func finalizeDownload(fileInfo []FileInfo, token string) FinalizeResponse {
 
 	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
 	if !statusOK {
-		fmt.Println(response)
 		responseBody, _ := io.ReadAll(response.Body)
-		fmt.Println(string(responseBody))
-		panic("Finalize request failed")
+		panic(newHttpStatusError("Finalize request", response, responseBody))
 	}
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+const (
+	CheckOk   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+const (
+	// Upper bound for every network check
+	doctorTimeout = 15 * time.Second
+	// Expiry times are computed locally, the server deletes by its own clock
+	maxClockSkew     = time.Minute
+	maxFatalSkew     = 5 * time.Minute
+	certExpiryWarn   = 14 * 24 * time.Hour
+	minFreeTempSpace = 1000 * 1000 * 1000
+)
+
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok, warn, fail or skip
+	Detail string `json:"detail"`
+}
+
+type DoctorResult struct {
+	Schema  int           `json:"schema"`
+	Command string        `json:"command"`
+	BaseUrl string        `json:"base_url"`
+	Ok      bool          `json:"ok"` // no check failed
+	Checks  []DoctorCheck `json:"checks"`
+}
+
+func (r *DoctorResult) add(name string, status string, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, DoctorCheck{name, status, fmt.Sprintf(format, a...)})
+	if status == CheckFail {
+		r.Ok = false
+	}
+}
+
+// runDoctor checks the configuration, the connection to the server of the
+// active profile and the local environment. It does not upload anything.
+func runDoctor(ctx context.Context, options *Options) DoctorResult {
+	result := DoctorResult{
+		Schema:  outputSchemaVersion,
+		Command: "doctor",
+		BaseUrl: activeProfile.BaseUrl,
+		Ok:      true,
+		Checks:  make([]DoctorCheck, 0),
+	}
+	checkConfigFiles(&result, options)
+	baseUrl, err := url.Parse(activeProfile.BaseUrl)
+	if err != nil || baseUrl.Host == "" {
+		result.add("server", CheckFail, "invalid base url %s", activeProfile.BaseUrl)
+		return result
+	}
+	proxy := checkProxy(ctx, &result, baseUrl)
+	checkDns(ctx, &result, baseUrl, proxy != nil)
+	checkServer(ctx, &result, baseUrl)
+	checkTempDir(&result)
+	return result
+}
+
+// checkConfigFiles reports the config file, the organization policy file and
+// the profile built from them.
+func checkConfigFiles(result *DoctorResult, options *Options) {
+	path := configPath()
+	configErr := error(nil)
+	switch _, err := os.Stat(path); {
+	case path == "":
+		result.add("config", CheckWarn, "no config directory, using the defaults")
+	case os.IsNotExist(err):
+		result.add("config", CheckOk, "%s does not exist, using the defaults", path)
+	default:
+		if _, configErr = loadConfig(path); configErr != nil {
+			result.add("config", CheckFail, "%v", configErr)
+		} else {
+			result.add("config", CheckOk, "%s", path)
+		}
+	}
+
+	policyPath := orgPolicyPath()
+	policyErr := loadOrgPolicy()
+	switch _, err := os.Stat(policyPath); {
+	case policyErr != nil:
+		result.add("policy", CheckFail, "%v", policyErr)
+	case os.IsNotExist(err):
+		result.add("policy", CheckOk, "%s does not exist, no organization policy", policyPath)
+	default:
+		result.add("policy", CheckOk, "%s", policyPath)
+	}
+
+	// The errors of the files are reported above, the rest by the profile
+	if configErr != nil || policyErr != nil {
+		result.add("profile", CheckSkip, "the configuration could not be read, using the defaults")
+		return
+	}
+	name := profileName(options)
+	if name == "" {
+		name = "none"
+	}
+	if configError != nil {
+		result.add("profile", CheckFail, "%v", configError)
+		return
+	}
+	result.add("profile", CheckOk, "%s, server %s", name, activeProfile.BaseUrl)
+}
+
+// checkProxy reports the proxy the requests to the server go through, and
+// whether it accepts connections. It returns the proxy, nil for none.
+func checkProxy(ctx context.Context, result *DoctorResult, baseUrl *url.URL) *url.URL {
+	request := &http.Request{Method: http.MethodGet, URL: baseUrl, Header: http.Header{}}
+	proxy, err := http.DefaultTransport.(*http.Transport).Proxy(request)
+	if err != nil {
+		result.add("proxy", CheckFail, "%v", err)
+		return nil
+	}
+	if proxy == nil {
+		result.add("proxy", CheckOk, "none, connecting directly")
+		return nil
+	}
+	source := "from HTTPS_PROXY / HTTP_PROXY"
+	if activeProfile.Proxy != "" {
+		source = "from --proxy or the profile"
+	}
+	// The user info of a proxy url is its password
+	shown := *proxy
+	shown.User = nil
+	address := proxy.Host
+	if proxy.Port() == "" {
+		address = net.JoinHostPort(proxy.Hostname(), "80")
+		if proxy.Scheme == "https" {
+			address = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		result.add("proxy", CheckFail, "%s (%s) is not reachable: %v", shown.String(), source, err)
+		return proxy
+	}
+	conn.Close()
+	result.add("proxy", CheckOk, "%s (%s)", shown.String(), source)
+	return proxy
+}
+
+// checkDns resolves the server. Behind a proxy the proxy resolves it, a local
+// failure is only a warning then.
+func checkDns(ctx context.Context, result *DoctorResult, baseUrl *url.URL, proxied bool) {
+	host := baseUrl.Hostname()
+	if net.ParseIP(host) != nil {
+		result.add("dns", CheckSkip, "%s is an IP address", host)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	start := time.Now()
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	switch {
+	case err != nil && proxied:
+		result.add("dns", CheckWarn, "%v, the proxy has to resolve it", err)
+	case err != nil:
+		result.add("dns", CheckFail, "%v", err)
+	default:
+		result.add("dns", CheckOk, "%s is %s (%dms)", host, strings.Join(addresses, ", "), time.Since(start).Milliseconds())
+	}
+}
+
+// checkServer calls upload/info once, without retries, and reports the TLS
+// handshake, the answer and the clock of the server from it.
+func checkServer(ctx context.Context, result *DoctorResult, baseUrl *url.URL) {
+	handshake := false
+	var tlsState tls.ConnectionState
+	var tlsErr error
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			handshake = true
+			tlsState = state
+			tlsErr = err
+		},
+	}
+	ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(ctx, trace), doctorTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl("upload/info/"), nil)
+	if err != nil {
+		panic(err)
+	}
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	elapsed := time.Since(start)
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+
+	switch {
+	case baseUrl.Scheme != "https":
+		result.add("tls", CheckWarn, "%s is not encrypted, only the files are", baseUrl.Scheme)
+	case !handshake:
+		result.add("tls", CheckSkip, "no connection to the server")
+	case tlsErr != nil:
+		result.add("tls", CheckFail, "%v", tlsErr)
+	default:
+		checkCertificates(result, &tlsState)
+	}
+
+	if err != nil {
+		result.add("api", CheckFail, "%v", err)
+		result.add("clock", CheckSkip, "no answer from the server")
+		return
+	}
+	checkUploadInfo(result, response, body, elapsed)
+	checkClock(result, response.Header.Get("Date"), start.Add(elapsed/2))
+}
+
+func checkCertificates(result *DoctorResult, state *tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		result.add("tls", CheckFail, "the server sent no certificate")
+		return
+	}
+	certificate := state.PeerCertificates[0]
+	chain := len(state.PeerCertificates)
+	if len(state.VerifiedChains) > 0 {
+		chain = len(state.VerifiedChains[0])
+	}
+	detail := fmt.Sprintf("%s, certificate of %s issued by %s, chain of %d verified, expires %s",
+		tls.VersionName(state.Version),
+		certificate.Subject.CommonName,
+		certificate.Issuer.CommonName,
+		chain,
+		formatTime(certificate.NotAfter))
+	if time.Until(certificate.NotAfter) < certExpiryWarn {
+		result.add("tls", CheckWarn, "%s, in less than %d days", detail, int(certExpiryWarn.Hours()/24))
+		return
+	}
+	result.add("tls", CheckOk, "%s", detail)
+}
+
+// checkUploadInfo verifies that the server answered like the sft server, and
+// not like a captive portal or another site.
+func checkUploadInfo(result *DoctorResult, response *http.Response, body []byte, elapsed time.Duration) {
+	if response.StatusCode != http.StatusOK {
+		result.add("api", CheckFail, "upload/info answered %s", response.Status)
+		return
+	}
+	info := MaxUploadSize{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		result.add("api", CheckFail, "upload/info did not answer JSON (%s): %v", response.Header.Get("Content-Type"), err)
+		return
+	}
+	if info.MaxSize <= 0 {
+		result.add("api", CheckWarn, "upload/info has no max_upload_size_bytes, uploads assume %s", formatBytes(assumedMaxUploadSize))
+		return
+	}
+	result.add("api", CheckOk, "upload/info answered in %dms, maximum upload size %s", elapsed.Milliseconds(), formatBytes(info.MaxSize))
+}
+
+// checkClock compares the Date header of the server with the local time of
+// the middle of the request.
+func checkClock(result *DoctorResult, date string, local time.Time) {
+	if date == "" {
+		result.add("clock", CheckSkip, "the server sent no Date header")
+		return
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		result.add("clock", CheckSkip, "invalid Date header %s", date)
+		return
+	}
+	// The header has a resolution of a second
+	skew := local.Sub(serverTime).Truncate(time.Second)
+	direction := "ahead of"
+	if skew < 0 {
+		skew = -skew
+		direction = "behind"
+	}
+	switch {
+	case skew > maxFatalSkew:
+		result.add("clock", CheckFail, "the local clock is %s %s the server, expiry times will be wrong", skew, direction)
+	case skew > maxClockSkew:
+		result.add("clock", CheckWarn, "the local clock is %s %s the server", skew, direction)
+	default:
+		result.add("clock", CheckOk, "within %s of the server", maxClockSkew)
+	}
+}
+
+// checkTempDir verifies that the temp directory is writable and has room.
+func checkTempDir(result *DoctorResult) {
+	dir := os.TempDir()
+	file, err := os.CreateTemp(dir, ".sft-doctor-*")
+	if err != nil {
+		result.add("temp dir", CheckFail, "%v", err)
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+	free, err := freeSpace(dir)
+	switch {
+	case err != nil:
+		result.add("temp dir", CheckOk, "%s is writable, free space unknown: %v", dir, err)
+	case free < minFreeTempSpace:
+		result.add("temp dir", CheckWarn, "%s has only %s free", dir, formatBytes(free))
+	default:
+		result.add("temp dir", CheckOk, "%s has %s free", dir, formatBytes(free))
+	}
+}
+
+func printDoctorResult(result *DoctorResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.SetTitle("sft doctor: " + result.BaseUrl)
+	t.AppendHeader(table.Row{"Check", "Status", "Detail"})
+	for _, check := range result.Checks {
+		t.AppendRow(table.Row{check.Name, strings.ToUpper(check.Status), check.Detail})
+	}
+	t.Render()
+}
+
+// exitOnFailedChecks exits with 1 when a check failed, after the report.
+func exitOnFailedChecks(result *DoctorResult) {
+	if !result.Ok {
+		fmt.Fprintln(os.Stderr, "Some checks failed")
+		os.Exit(1)
+	}
+}
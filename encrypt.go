@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -16,29 +18,213 @@ import (
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/term"
 )
 
-func encryptFiles(files []string, options *Options) string {
-	const url = "https://filetransfer.kpn.com/download/"
-	maxSize := getMaxUploadSize()
-	checkFiles(files, maxSize)
+// UploadPiece is a file, or a part of one when splitting, uploaded as one
+// file of a transfer.
+type UploadPiece struct {
+	Path        string
+	Name        string
+	Offset      int64
+	Size        int64
+	ContentType string
+	Checksum    *FileChecksum
+}
+
+func wholeFiles(files []string, options *Options) []UploadPiece {
+	pieces := make([]UploadPiece, 0)
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			panic(err)
+		}
+		pieces = append(pieces, UploadPiece{
+			file,
+			stat.Name(),
+			0,
+			stat.Size(),
+			contentTypeForFile(file),
+			newFileChecksum(options.ChecksumAlgorithm, options.EmbedChecksums),
+		})
+	}
+	return pieces
+}
+
+func encryptFiles(ctx context.Context, files []string, options *Options) {
+	// Check the key options before anything is uploaded
+	recipientKey(options)
+	checkSeparateKey(options)
+	checkWebhookOptions(options)
+	if !isValidChecksumAlgorithm(options.ChecksumAlgorithm) {
+		fatal("Unknown checksum algorithm: %s", options.ChecksumAlgorithm)
+	}
+	loadActiveSigningKey()
+	if signingKey != nil {
+		// The signature covers the content through the checksums
+		options.EmbedChecksums = true
+	}
+	enforceTransferPolicy(options)
+	recipients := checkRecipients(options)
+	enforcePolicy(files, options)
+	maxSize, fetched := getMaxUploadSize(ctx)
+	pieces := wholeFiles(files, options)
+	uploadSize := computeUploadSize(pieces)
+	if recipients != nil {
+		checkUploadSize(uploadSize, maxSize, fetched)
+		readPasswordIfNeeded(options)
+		result := encryptFanOut(ctx, pieces, uploadSize, recipients, options)
+		printFanOutResult(&result)
+		return
+	}
+	if options.Split && uploadSize.total() > maxSize {
+		result := encryptSplit(ctx, pieces, maxSize, options)
+		printSplitResult(&result)
+		return
+	}
+	checkUploadSize(uploadSize, maxSize, fetched)
 	readPasswordIfNeeded(options)
-	transfer := createUploadRequest()
-	uploadedFiles := uploadFiles(files, &transfer)
-	uploadedData := uploadMetadata(uploadedFiles, &transfer)
-	return url + uploadedData.Uuid + "#" + uploadedData.Secret
+	result := encryptTransfer(ctx, pieces, uploadSize, options)
+	printEncryptResult(&result)
 }
 
-func uploadMetadata(uploadedFiles []UploadedFile, transfer *Transfer) UploadedData {
-	const url = "https://filetransfer.kpn.com/api/v1/upload/metadata/"
-	metadata := Metadata{
-		"",
-		uploadedFiles,
+// encryptTransfer uploads the pieces as a new transfer.
+func encryptTransfer(ctx context.Context, pieces []UploadPiece, uploadSize UploadSize, options *Options) EncryptResult {
+	transfer := createUploadRequest(ctx, &activeProfile)
+	createdAt := time.Now()
+	emitEvent("transfer_created", map[string]interface{}{"transfer_id": transfer.Uuid})
+	defer deleteTransferOnCancel(ctx, &transfer, options)
+	uploadedFiles := uploadFiles(ctx, pieces, &transfer, newUploadQuota(uploadSize))
+	return completeTransfer(ctx, "encrypt", &transfer, createdAt, uploadedFiles, "", options)
+}
+
+// completeTransfer uploads the metadata of the uploaded files and records the
+// transfer in the history.
+func completeTransfer(ctx context.Context, command string, transfer *Transfer, createdAt time.Time, uploadedFiles []UploadedFile, label string, options *Options) EncryptResult {
+	url := downloadPageUrl()
+	uploadedData := uploadMetadata(ctx, options.Description, metadataFiles(uploadedFiles, options.EmbedChecksums), transfer)
+
+	fragment := uploadedData.Secret
+	if recipient := recipientKey(options); recipient != nil {
+		fragment = wrapFragment(fragment, recipient)
+	}
+	result := EncryptResult{
+		Schema:            outputSchemaVersion,
+		Command:           command,
+		Label:             label,
+		Link:              url + uploadedData.Uuid + "#" + fragment,
+		TransferId:        transfer.Uuid,
+		ManagementToken:   transfer.Token,
+		DeleteAfter:       transfer.DeleteAfter,
+		ExpiresAt:         formatTime(expiryTime(createdAt, transfer.DeleteAfter)),
+		DownloadLimit:     downloadLimit(transfer.DeleteAfterCount),
+		Recipient:         options.Recipient,
+		ChecksumAlgorithm: options.ChecksumAlgorithm,
+		Files:             make([]EncryptFileResult, 0),
+	}
+	// The history keeps the complete link, with the key not wrapped for the
+	// recipient, so status works for the sender
+	entry := HistoryEntry{
+		Id:              transfer.Uuid,
+		Label:           label,
+		Link:            url + uploadedData.Uuid + "#" + uploadedData.Secret,
+		ManagementToken: transfer.Token,
+		BaseUrl:         activeProfile.BaseUrl,
+		Files:           make([]HistoryFile, 0),
+		DeleteAfter:     transfer.DeleteAfter,
+		DownloadLimit:   result.DownloadLimit,
+		CreatedAt:       createdAt.UTC(),
+		ExpiresAt:       expiryTime(createdAt, transfer.DeleteAfter).UTC(),
+	}
+	for _, file := range uploadedFiles {
+		result.Files = append(result.Files, EncryptFileResult{
+			file.Name,
+			file.Size,
+			file.FileType,
+			len(file.Chunks),
+			file.Checksums[options.ChecksumAlgorithm],
+		})
+		entry.Files = append(entry.Files, HistoryFile{file.Name, file.Size})
+	}
+	if !options.NoHistory {
+		recordTransfer(entry)
+	}
+	separateKey(&result, fragment, options)
+	notifyUpload(ctx, &result, options)
+	return result
+}
+
+// recipientKey returns the public key of --recipient, or nil without one.
+func recipientKey(options *Options) *ecdh.PublicKey {
+	if options.Recipient == "" {
+		return nil
+	}
+	publicKey, err := parsePublicKey(options.Recipient)
+	if err != nil {
+		fatal("Invalid recipient %s: %v", options.Recipient, err)
+	}
+	return publicKey
+}
+
+// deleteTransferOnCancel removes the half uploaded transfer from the server
+// when the upload was interrupted and the user asked for it. It is deferred,
+// so it re-panics to let main report the interruption.
+func deleteTransferOnCancel(ctx context.Context, transfer *Transfer, options *Options) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if ctx.Err() != nil && options.DeleteOnCancel {
+		deleteCancelledTransfer(transfer)
+	}
+	panic(r)
+}
+
+func deleteCancelledTransfer(transfer *Transfer) {
+	fmt.Fprintln(os.Stderr, "Deleting the incomplete transfer from the server")
+	// ctx is already cancelled, the cleanup gets a short deadline of its own
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := deleteTransfer(cleanupCtx, transfer.Token); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not delete the transfer:", err)
 	}
+}
+
+// discardTransfer deletes an incomplete transfer that can't be completed.
+func discardTransfer(ctx context.Context, transfer *Transfer) {
+	if err := deleteTransfer(ctx, transfer.Token); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not delete the incomplete transfer:", err)
+	}
+}
+
+func deleteTransfer(ctx context.Context, managementToken string) error {
+	url := apiUrl("upload/request/")
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("transfer_management_token", managementToken)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	_, err = doWithRetry(ctx, "Transfer deletion", requestRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "DELETE", url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		return request, nil
+	})
+	return err
+}
 
-	data, err := json.Marshal(metadata)
+func uploadMetadata(ctx context.Context, description string, uploadedFiles []UploadedFile, transfer *Transfer) UploadedData {
+	url := apiUrl("upload/metadata/")
+	data, err := json.Marshal(newMetadata(description, uploadedFiles))
 	if err != nil {
 		panic(err)
 	}
@@ -60,7 +246,7 @@ func uploadMetadata(uploadedFiles []UploadedFile, transfer *Transfer) UploadedDa
 	if err != nil {
 		panic(err)
 	}
-	request, err := http.NewRequest("PUT", url, body)
+	request, err := http.NewRequestWithContext(ctx, "PUT", url, body)
 	if err != nil {
 		panic(err)
 	}
@@ -70,15 +256,11 @@ func uploadMetadata(uploadedFiles []UploadedFile, transfer *Transfer) UploadedDa
 	if err != nil {
 		panic(err)
 	}
+	defer response.Body.Close()
 	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
 	if !statusOK {
-		fmt.Println(response)
-		responseBody, err := io.ReadAll(response.Body)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println(string(responseBody))
-		panic("Upload metadata failed")
+		responseBody, _ := io.ReadAll(response.Body)
+		panic(newHttpStatusError("Upload metadata", response, responseBody))
 	}
 	base64key := base64.URLEncoding.EncodeToString(encryptionData.KeyMaterial)
 	base64key = strings.ReplaceAll(base64key, "=", ".")
@@ -89,48 +271,82 @@ func uploadMetadata(uploadedFiles []UploadedFile, transfer *Transfer) UploadedDa
 	}
 }
 
-type MaxUploadSize struct {
-	MaxSize int `json:"max_upload_size_bytes"`
+// metadataFiles drops the checksums unless they go into the metadata.
+func metadataFiles(uploadedFiles []UploadedFile, embedChecksums bool) []UploadedFile {
+	if embedChecksums {
+		return uploadedFiles
+	}
+	files := make([]UploadedFile, 0)
+	for _, file := range uploadedFiles {
+		file.Checksums = nil
+		files = append(files, file)
+	}
+	return files
 }
 
-func getMaxUploadSize() int {
-	const url = "https://filetransfer.kpn.com/api/v1/upload/info/"
-	response, err := http.Get(url)
-	if err != nil {
-		panic(err)
+func newMetadata(description string, uploadedFiles []UploadedFile) Metadata {
+	metadata := Metadata{
+		description,
+		uploadedFiles,
+		nil,
 	}
-	defer response.Body.Close()
+	signMetadata(&metadata)
+	return metadata
+}
 
-	if response.StatusCode != http.StatusOK {
-		// We could also just panic
-		return 4294967296
-	}
-	responseBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		panic(err)
+type MaxUploadSize struct {
+	MaxSize int64 `json:"max_upload_size_bytes"`
+}
+
+// Used when the server doesn't tell its limit.
+const assumedMaxUploadSize = 4294967296
+
+// getMaxUploadSize returns the upload limit of the server and whether it was
+// fetched, or the assumed limit when the info endpoint is not available.
+func getMaxUploadSize(ctx context.Context) (int64, bool) {
+	url := apiUrl("upload/info/")
+	responseBody, err := doWithRetry(ctx, "Upload info", requestRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+	if err == nil {
+		maxSizeResponse := MaxUploadSize{}
+		err = json.Unmarshal(responseBody, &maxSizeResponse)
+		if err == nil && maxSizeResponse.MaxSize > 0 {
+			return maxSizeResponse.MaxSize, true
+		}
 	}
-	maxSizeResponse := MaxUploadSize{}
-	err = json.Unmarshal(responseBody, &maxSizeResponse)
-	if err != nil {
-		panic(err)
+	if ctx.Err() != nil {
+		panic(ctx.Err())
 	}
-	return maxSizeResponse.MaxSize
+	printStatus("Could not fetch the maximum upload size of the server, assuming %s: %v", formatBytes(assumedMaxUploadSize), err)
+	return assumedMaxUploadSize, false
 }
 
-func checkFiles(files []string, maxSize int) {
+func totalFileSize(pieces []UploadPiece) int64 {
 	totalSize := int64(0)
-	for _, file := range files {
-		stat, err := os.Stat(file)
-		if err != nil {
-			panic(err)
-		}
-		totalSize += stat.Size()
+	for _, piece := range pieces {
+		totalSize += piece.Size
 	}
-	if totalSize > int64(maxSize) {
-		fmt.Println("The toal size of files are too big.")
-		fmt.Println("Maximum upload size is: ", maxSize)
-		os.Exit(1)
+	return totalSize
+}
+
+// checkUploadSize refuses the upload before anything is sent when the
+// encrypted files don't fit in maxSize.
+func checkUploadSize(size UploadSize, maxSize int64, fetched bool) {
+	if size.total() <= maxSize {
+		return
 	}
+	limit := "Maximum upload size of the server:"
+	if !fetched {
+		limit = "Assumed maximum upload size:"
+	}
+	fmt.Fprintln(os.Stderr, "The files are too big for a single transfer.")
+	fmt.Fprintf(os.Stderr, "%-36s%s\n", "File contents:", formatBytes(size.Plaintext))
+	fmt.Fprintf(os.Stderr, "%-36s%s\n", "Encryption overhead:", formatBytes(size.Overhead))
+	fmt.Fprintf(os.Stderr, "%-36s%s\n", "Encrypted metadata:", formatBytes(size.Metadata))
+	fmt.Fprintf(os.Stderr, "%-36s%s\n", "Total upload size:", formatBytes(size.total()))
+	fmt.Fprintf(os.Stderr, "%-36s%s\n", limit, formatBytes(maxSize))
+	fatal("The upload is %s too big, use --split to upload it as several transfers", formatBytes(size.total()-maxSize))
 }
 
 func readPasswordIfNeeded(options *Options) {
@@ -138,7 +354,7 @@ func readPasswordIfNeeded(options *Options) {
 		return
 	}
 
-	fmt.Println("Please enter the password:")
+	fmt.Fprintln(humanOut, "Please enter the password:")
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		panic(err)
@@ -162,11 +378,13 @@ type Transfer struct {
 	DeleteAfterCount string `json:"delete_after_count"`
 }
 
-func createUploadRequest() Transfer {
-	const url = "https://filetransfer.kpn.com/api/v1/upload/request/"
+// createUploadRequest creates a transfer with the expiry and the download
+// limit of the profile.
+func createUploadRequest(ctx context.Context, profile *Profile) Transfer {
+	url := apiUrl("upload/request/")
 	uploadParameters := UploadParameters{
-		"7d",
-		"2l",
+		profile.DeleteAfter,
+		fmt.Sprintf("%dl", profile.DeleteAfterCount),
 	}
 
 	uploadParamsJson, err := json.Marshal(uploadParameters)
@@ -174,7 +392,12 @@ func createUploadRequest() Transfer {
 		panic(err)
 	}
 
-	response, err := http.Post(url, "application/json", bytes.NewBuffer(uploadParamsJson))
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(uploadParamsJson))
+	if err != nil {
+		panic(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		panic(err)
 	}
@@ -182,7 +405,8 @@ func createUploadRequest() Transfer {
 
 	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
 	if !statusOK {
-		panic("Upload request failed")
+		responseBody, _ := io.ReadAll(response.Body)
+		panic(newHttpStatusError("Upload request", response, responseBody))
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
@@ -206,58 +430,67 @@ func contentTypeForFile(filePath string) string {
 	defer file.Close()
 
 	n, err := file.Read(head)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		panic(err)
 	}
 	return http.DetectContentType(head[:n])
 }
 
-func uploadFiles(files []string, transfer *Transfer) []UploadedFile {
+func uploadFiles(ctx context.Context, pieces []UploadPiece, transfer *Transfer, quota *UploadQuota) []UploadedFile {
 	uploadedFiles := make([]UploadedFile, 0)
-	for _, file := range files {
-		fmt.Println("Uploading ", file)
-		fileUuids := uploadFile(file, transfer)
-		stat, err := os.Stat(file)
-		if err != nil {
-			panic(err)
-		}
+	transferProgress := newTransferProgress("Uploading", "Uploaded", totalFileSize(pieces))
+	for _, piece := range pieces {
+		fileProgress := transferProgress.startFile(piece.Name, piece.Size)
+		fileUuids, checksums := uploadFile(ctx, &piece, transfer, quota, fileProgress)
 		fileData := UploadedFile{
-			stat.Name(),
-			int(stat.Size()),
+			piece.Name,
+			int(piece.Size),
 			fileUuids,
-			contentTypeForFile(file),
+			piece.ContentType,
+			checksums,
 		}
 
 		uploadedFiles = append(uploadedFiles, fileData)
-		fmt.Println(" done")
+		fileProgress.finish()
 	}
-	fmt.Println("")
+	transferProgress.finish()
 	return uploadedFiles
 }
 
-func uploadFile(filePath string, transfer *Transfer) []UploadedData {
-	const chunkSize = 16 * 1024 * 1024 // 16 MB
+type uploadedChunk struct {
+	data      UploadedData
+	plaintext []byte
+}
+
+// uploadFile uploads the chunks of a piece and returns them with the
+// checksum of the piece. The chunks are hashed in order as they finish.
+func uploadFile(ctx context.Context, piece *UploadPiece, transfer *Transfer, quota *UploadQuota, fileProgress *FileProgress) ([]UploadedData, map[string]string) {
 	uploadedChunks := make([]UploadedData, 0)
-	file, err := os.Open(filePath)
+	checksummer := newChecksummer(piece.Checksum.Algorithm)
+	file, err := os.Open(piece.Path)
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
 
-	buffer := make([]byte, chunkSize)
-	for {
-		n, err := file.Read(buffer)
+	upload := func(ctx context.Context, i int) uploadedChunk {
+		offset := int64(i) * maxChunkSize
+		buffer := make([]byte, min(maxChunkSize, piece.Size-offset))
+		_, err := file.ReadAt(buffer, piece.Offset+offset)
 		if err != nil {
-			if err == io.EOF {
-				break // Normal end of file
-			}
 			panic(err)
 		}
-		uploadedData := uploadData(buffer[:n], transfer)
-		uploadedChunks = append(uploadedChunks, uploadedData)
-		fmt.Print(".")
-	}
-	return uploadedChunks
+		chunkProgress := fileProgress.startChunk(int64(len(buffer)))
+		uploadedData := uploadData(ctx, buffer, transfer, quota, chunkProgress)
+		chunkProgress.done(int64(len(buffer)))
+		return uploadedChunk{uploadedData, buffer}
+	}
+	orderedParallel(ctx, activeProfile.Parallelism, numChunks(piece.Size), upload, func(i int, chunk uploadedChunk) {
+		checksummer.Write(chunk.plaintext)
+		piece.Checksum.file.Write(chunk.plaintext)
+		uploadedChunks = append(uploadedChunks, chunk.data)
+	})
+	return uploadedChunks, checksummer.sums()
 }
 
 type EncryptionData struct {
@@ -272,22 +505,36 @@ type TransferFileId struct {
 }
 
 type TransferRemainingUploadSize struct {
-	Available int `json:"available_upload_size_in_bytes"`
+	Available int64 `json:"available_upload_size_in_bytes"`
 }
 
 type FileUploadResponse struct {
-	Uuid      TransferFileId              `json:"created_transfer_file"`
-	Available TransferRemainingUploadSize `json:"transfer"`
+	Uuid      TransferFileId               `json:"created_transfer_file"`
+	Available *TransferRemainingUploadSize `json:"transfer"`
 }
 
-func uploadData(data []byte, transfer *Transfer) UploadedData {
-	const url = "https://filetransfer.kpn.com/api/v1/upload/file/"
+func uploadData(ctx context.Context, data []byte, transfer *Transfer, quota *UploadQuota, chunkProgress *ChunkProgress) UploadedData {
 	cipherText, encryptionData := encryptData(data)
-	hash := sha256.New()
-	hash.Write(cipherText)
-	cipherTextHash := hash.Sum(nil)
-	encodedCipherText := hex.EncodeToString(cipherTextHash)
-	hash.Reset()
+	uuid := uploadCipherText(ctx, cipherText, cipherTextHash(cipherText), transfer, quota, chunkProgress)
+
+	base64key := base64.URLEncoding.EncodeToString(encryptionData.KeyMaterial)
+	base64key = strings.ReplaceAll(base64key, "=", ".")
+
+	return UploadedData{
+		uuid,
+		base64key,
+	}
+}
+
+// cipherTextHash is the encrypted_contents_hash the server checks a chunk with.
+func cipherTextHash(cipherText []byte) string {
+	hash := sha256.Sum256(cipherText)
+	return hex.EncodeToString(hash[:])
+}
+
+// uploadCipherText uploads an encrypted chunk and returns its id.
+func uploadCipherText(ctx context.Context, cipherText []byte, encodedCipherText string, transfer *Transfer, quota *UploadQuota, chunkProgress *ChunkProgress) string {
+	url := apiUrl("upload/file/")
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
@@ -311,25 +558,20 @@ func uploadData(data []byte, transfer *Transfer) UploadedData {
 		panic(err)
 	}
 
-	request, err := http.NewRequest(
-		"POST",
-		url,
-		body,
-	)
-
-	request.Header.Set("Content-Type", writer.FormDataContentType())
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		panic(err)
-	}
-	defer response.Body.Close()
-
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		panic("Upload failed")
-	}
-
-	responseBody, err := io.ReadAll(response.Body)
+	requestBody := body.Bytes()
+	contentType := writer.FormDataContentType()
+	quota.start(int64(len(cipherText)))
+	responseBody, err := doWithRetry(ctx, "Chunk upload", chunkRetryPolicy, func(ctx context.Context) (*http.Request, error) {
+		requestReader := chunkProgress.reader(bytes.NewReader(requestBody))
+		request, err := http.NewRequestWithContext(ctx, "POST", url, requestReader)
+		if err != nil {
+			return nil, err
+		}
+		// The counting reader hides the length from net/http
+		request.ContentLength = int64(len(requestBody))
+		request.Header.Set("Content-Type", contentType)
+		return request, nil
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -338,14 +580,10 @@ func uploadData(data []byte, transfer *Transfer) UploadedData {
 	if err != nil {
 		panic(err)
 	}
-
-	base64key := base64.URLEncoding.EncodeToString(encryptionData.KeyMaterial)
-	base64key = strings.ReplaceAll(base64key, "=", ".")
-
-	return UploadedData{
-		fileUploadResponse.Uuid.Uuid,
-		base64key,
+	if fileUploadResponse.Available != nil {
+		quota.done(int64(len(cipherText)), fileUploadResponse.Available.Available)
 	}
+	return fileUploadResponse.Uuid.Uuid
 }
 
 func encryptData(data []byte) ([]byte, EncryptionData) {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upper bound for --recipients, every chunk is uploaded once per recipient.
+const maxRecipients = 100
+
+// FanOutRecipient gets a transfer of its own, the settings override the
+// profile when set.
+type FanOutRecipient struct {
+	Label         string
+	DeleteAfter   string
+	DownloadLimit int
+}
+
+type FanOutResult struct {
+	Schema    int             `json:"schema"`
+	Command   string          `json:"command"`
+	Transfers []EncryptResult `json:"transfers"`
+}
+
+// parseRecipients reads --recipients: a number of recipients or a list of
+// labels, each optionally followed by its expiry and download limit.
+func parseRecipients(value string) ([]FanOutRecipient, error) {
+	recipients := make([]FanOutRecipient, 0)
+	if count, err := strconv.Atoi(value); err == nil {
+		if count < 1 || count > maxRecipients {
+			return nil, fmt.Errorf("between 1 and %d recipients are supported", maxRecipients)
+		}
+		for i := 1; i <= count; i++ {
+			recipients = append(recipients, FanOutRecipient{Label: fmt.Sprintf("recipient-%d", i)})
+		}
+		return recipients, nil
+	}
+	labels := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if fields[0] == "" || len(fields) > 3 {
+			return nil, fmt.Errorf("%q: expected name[:period[:downloads]]", entry)
+		}
+		if labels[fields[0]] {
+			return nil, fmt.Errorf("%s is listed twice", fields[0])
+		}
+		labels[fields[0]] = true
+		recipient := FanOutRecipient{Label: fields[0]}
+		if len(fields) > 1 {
+			// Checked now, a typo must not fail the command after the first transfers
+			if _, ok := deleteAfterDuration(fields[1]); fields[1] != "" && !ok {
+				return nil, fmt.Errorf("%s: invalid period %s", fields[0], fields[1])
+			}
+			recipient.DeleteAfter = fields[1]
+		}
+		if len(fields) > 2 {
+			limit, err := strconv.Atoi(fields[2])
+			if err != nil || limit < 1 {
+				return nil, fmt.Errorf("%s: invalid download limit %s", fields[0], fields[2])
+			}
+			recipient.DownloadLimit = limit
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) > maxRecipients {
+		return nil, errors.New("too many recipients")
+	}
+	return recipients, nil
+}
+
+// checkRecipients validates --recipients before anything is uploaded, nil
+// without it.
+func checkRecipients(options *Options) []FanOutRecipient {
+	if options.Recipients == "" {
+		return nil
+	}
+	if options.Split {
+		fatal("--split can't be combined with --recipients")
+	}
+	recipients, err := parseRecipients(options.Recipients)
+	if err != nil {
+		fatal("Invalid --recipients %s: %v", options.Recipients, err)
+	}
+	for _, recipient := range recipients {
+		deleteAfter, deleteAfterCount := activeProfile.DeleteAfter, activeProfile.DeleteAfterCount
+		if recipient.DeleteAfter != "" {
+			deleteAfter = recipient.DeleteAfter
+		}
+		if recipient.DownloadLimit > 0 {
+			deleteAfterCount = recipient.DownloadLimit
+		}
+		checkTransferLimits(deleteAfter, deleteAfterCount)
+	}
+	return recipients
+}
+
+type fanOutChunk struct {
+	uuids     []string
+	secret    string
+	plaintext []byte
+}
+
+// encryptFanOut encrypts every chunk once and uploads the ciphertext into a
+// transfer per recipient. The transfers share the chunk keys, but each has
+// metadata and a link key of its own, so the links are independent.
+func encryptFanOut(ctx context.Context, pieces []UploadPiece, uploadSize UploadSize, recipients []FanOutRecipient, options *Options) FanOutResult {
+	// Allocated up front, the cleanup holds on to the transfers created so far
+	transfers := make([]Transfer, 0, len(recipients))
+	defer deleteFanOutOnCancel(ctx, &transfers, options)
+	quotas := make([]*UploadQuota, 0)
+	for _, recipient := range recipients {
+		transfers = append(transfers, createRecipientTransfer(ctx, recipient, activeProfile))
+		quotas = append(quotas, newUploadQuota(uploadSize))
+	}
+	createdAt := time.Now()
+
+	uploadedFiles := make([][]UploadedFile, len(recipients))
+	transferProgress := newTransferProgress("Uploading", "Uploaded", totalFileSize(pieces)*int64(len(recipients)))
+	for _, piece := range pieces {
+		for t, file := range uploadFanOutPiece(ctx, piece, transfers, quotas, transferProgress) {
+			uploadedFiles[t] = append(uploadedFiles[t], file)
+		}
+	}
+	transferProgress.finish()
+
+	result := FanOutResult{
+		Schema:    outputSchemaVersion,
+		Command:   "encrypt",
+		Transfers: make([]EncryptResult, 0),
+	}
+	for t, recipient := range recipients {
+		result.Transfers = append(result.Transfers, completeTransfer(ctx, "encrypt", &transfers[t], createdAt, uploadedFiles[t], recipient.Label, options))
+	}
+	return result
+}
+
+// createRecipientTransfer creates the transfer of a recipient, with its own
+// expiry and download limit in place of those of the profile.
+func createRecipientTransfer(ctx context.Context, recipient FanOutRecipient, profile Profile) Transfer {
+	if recipient.DeleteAfter != "" {
+		profile.DeleteAfter = recipient.DeleteAfter
+	}
+	if recipient.DownloadLimit > 0 {
+		profile.DeleteAfterCount = recipient.DownloadLimit
+	}
+	transfer := createUploadRequest(ctx, &profile)
+	emitEvent("transfer_created", map[string]interface{}{"transfer_id": transfer.Uuid, "label": recipient.Label})
+	return transfer
+}
+
+// deleteFanOutOnCancel is deleteTransferOnCancel for the transfers of all
+// recipients.
+func deleteFanOutOnCancel(ctx context.Context, transfers *[]Transfer, options *Options) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if ctx.Err() != nil && options.DeleteOnCancel {
+		for i := range *transfers {
+			deleteCancelledTransfer(&(*transfers)[i])
+		}
+	}
+	panic(r)
+}
+
+// uploadFanOutPiece encrypts the chunks of a piece once and uploads them into
+// every transfer. It returns the file of the piece for every transfer.
+func uploadFanOutPiece(ctx context.Context, piece UploadPiece, transfers []Transfer, quotas []*UploadQuota, transferProgress *TransferProgress) []UploadedFile {
+	fileProgress := transferProgress.startFile(piece.Name, piece.Size*int64(len(transfers)))
+	checksummer := newChecksummer(piece.Checksum.Algorithm)
+	chunks := make([][]UploadedData, len(transfers))
+	file, err := os.Open(piece.Path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	upload := func(ctx context.Context, i int) fanOutChunk {
+		offset := int64(i) * maxChunkSize
+		buffer := make([]byte, min(maxChunkSize, piece.Size-offset))
+		_, err := file.ReadAt(buffer, piece.Offset+offset)
+		if err != nil {
+			panic(err)
+		}
+		cipherText, encryptionData := encryptData(buffer)
+		hash := cipherTextHash(cipherText)
+		chunk := fanOutChunk{make([]string, 0), keyFragment(encryptionData.KeyMaterial), buffer}
+		for t := range transfers {
+			chunkProgress := fileProgress.startChunk(int64(len(buffer)))
+			chunk.uuids = append(chunk.uuids, uploadCipherText(ctx, cipherText, hash, &transfers[t], quotas[t], chunkProgress))
+			chunkProgress.done(int64(len(buffer)))
+		}
+		return chunk
+	}
+	orderedParallel(ctx, activeProfile.Parallelism, numChunks(piece.Size), upload, func(i int, chunk fanOutChunk) {
+		checksummer.Write(chunk.plaintext)
+		for t, uuid := range chunk.uuids {
+			chunks[t] = append(chunks[t], UploadedData{uuid, chunk.secret})
+		}
+	})
+	files := make([]UploadedFile, 0)
+	for t := range transfers {
+		files = append(files, UploadedFile{
+			piece.Name,
+			int(piece.Size),
+			chunks[t],
+			piece.ContentType,
+			checksummer.sums(),
+		})
+	}
+	fileProgress.finish()
+	return files
+}
+
+func printFanOutResult(result *FanOutResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Printf("Successfully encrypted the file(s) and uploaded them for %d recipients\n", len(result.Transfers))
+	for _, transfer := range result.Transfers {
+		fmt.Println("")
+		fmt.Printf("%s (%s, %d downloads):\n", transfer.Label, transfer.DeleteAfter, transfer.DownloadLimit)
+		fmt.Println(transfer.Link)
+		if transfer.Key != "" || len(transfer.KeyShares) > 0 {
+			printSeparateKey(&transfer)
+		}
+		fmt.Println("Management token:", transfer.ManagementToken)
+	}
+	fmt.Println("")
+	printChecksums(result.Transfers[0].ChecksumAlgorithm, result.Transfers[0].Files)
+}
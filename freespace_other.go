@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+)
+
+// freeSpace is only implemented with statfs, doctor skips the free space
+// elsewhere.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the bytes available to the user on the file system of
+// dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
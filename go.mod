@@ -3,10 +3,14 @@ module example.com/sft
 go 1.21.0
 
 require (
-	github.com/jedib0t/go-pretty/v6 v6.4.6 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/jedib0t/go-pretty/v6 v6.4.6
+	golang.org/x/crypto v0.12.0
+	golang.org/x/term v0.11.0
+)
+
+require (
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/term v0.11.0 // indirect
 )
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// HistoryEntry is a transfer created by this machine. It contains the key
+// and the management token, the history file is only readable by the user.
+type HistoryEntry struct {
+	Id              string        `json:"id"`
+	Label           string        `json:"label,omitempty"`
+	Link            string        `json:"link"`
+	ManagementToken string        `json:"management_token"`
+	BaseUrl         string        `json:"base_url"`
+	Files           []HistoryFile `json:"files"`
+	DeleteAfter     string        `json:"delete_after"`
+	DownloadLimit   int           `json:"download_limit"`
+	CreatedAt       time.Time     `json:"created_at"`
+	ExpiresAt       time.Time     `json:"expires_at"`
+	Revoked         bool          `json:"revoked,omitempty"`
+}
+
+type HistoryFile struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+func (e *HistoryEntry) expired() bool {
+	return !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt)
+}
+
+func (e *HistoryEntry) totalSize() int64 {
+	total := int64(0)
+	for _, file := range e.Files {
+		total += int64(file.Size)
+	}
+	return total
+}
+
+// historyPath returns $SFT_HISTORY or $XDG_DATA_HOME/sft/history.json.
+func historyPath() (string, error) {
+	if path := os.Getenv("SFT_HISTORY"); path != "" {
+		return path, nil
+	}
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "sft", "history.json"), nil
+}
+
+func loadHistory() ([]HistoryEntry, error) {
+	entries := make([]HistoryEntry, 0)
+	path, err := historyPath()
+	if err != nil {
+		return entries, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return entries, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// saveHistory replaces the history file atomically, with 0600 permissions.
+func saveHistory(entries []HistoryEntry) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".history-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	// CreateTemp already uses 0600, make sure an umask can't change that
+	err = temp.Chmod(0600)
+	if err == nil {
+		_, err = temp.Write(data)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func recordTransfer(entry HistoryEntry) {
+	entries, err := loadHistory()
+	if err == nil {
+		err = saveHistory(append(entries, entry))
+	}
+	if err != nil {
+		// The transfer itself worked, the link is still printed
+		printStatus("Could not save the transfer to the history: %v", err)
+	}
+}
+
+// findHistoryEntry looks up a transfer by its id, link or management token.
+// A link matches whatever its key, the history has the one not wrapped for a
+// recipient.
+func findHistoryEntry(reference string) (HistoryEntry, bool) {
+	entries, err := loadHistory()
+	if err != nil {
+		panic(err)
+	}
+	address, _, _ := strings.Cut(reference, "#")
+	for _, entry := range entries {
+		entryAddress, _, _ := strings.Cut(entry.Link, "#")
+		if entry.Id == reference || entryAddress == address || entry.ManagementToken == reference {
+			return entry, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func markRevoked(id string) {
+	entries, err := loadHistory()
+	if err != nil {
+		panic(err)
+	}
+	for i := range entries {
+		if entries[i].Id == id {
+			entries[i].Revoked = true
+		}
+	}
+	err = saveHistory(entries)
+	if err != nil {
+		printStatus("Could not update the history: %v", err)
+	}
+}
+
+func printHistory() {
+	entries, err := loadHistory()
+	if err != nil {
+		panic(err)
+	}
+	if outputFormat != OutputText {
+		emitResult(map[string]interface{}{
+			"schema":    outputSchemaVersion,
+			"command":   "history",
+			"transfers": entries,
+		})
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No transfers yet.")
+		return
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.SetTitle("Transfers")
+	t.AppendHeader(table.Row{"Created", "Id", "Files", "Size", "Limit", "Expires", ""})
+	for _, entry := range entries {
+		names := make([]string, 0)
+		for _, file := range entry.Files {
+			names = append(names, file.Name)
+		}
+		id := entry.Id
+		if entry.Label != "" {
+			id += "\n" + entry.Label
+		}
+		state := ""
+		if entry.Revoked {
+			state = "revoked"
+		} else if entry.expired() {
+			state = "expired"
+		}
+		t.AppendRow(table.Row{
+			entry.CreatedAt.Local().Format("2006-01-02 15:04"),
+			id,
+			strings.Join(names, "\n"),
+			progress.UnitsBytes.Sprint(entry.totalSize()),
+			entry.DownloadLimit,
+			entry.ExpiresAt.Local().Format("2006-01-02 15:04"),
+			state,
+		})
+	}
+	t.Render()
+}
+
+type StatusResult struct {
+	Schema     int                 `json:"schema"`
+	Command    string              `json:"command"`
+	TransferId string              `json:"transfer_id"`
+	Available  bool                `json:"available"`
+	Expired    bool                `json:"expired"`
+	ExpiresAt  string              `json:"expires_at,omitempty"`
+	Transfer   *TransferResponse   `json:"transfer,omitempty"`
+	Files      []DecryptFileResult `json:"files"`
+}
+
+// transferStatus asks the server for the download counts of a transfer from
+// the history, or of any link.
+func transferStatus(ctx context.Context, idOrLink string) StatusResult {
+	link := idOrLink
+	result := StatusResult{
+		Schema:  outputSchemaVersion,
+		Command: "status",
+		Files:   make([]DecryptFileResult, 0),
+	}
+	entry, found := findHistoryEntry(idOrLink)
+	if found {
+		link = entry.Link
+		// The link may point to a server that is not in the config file any more
+		activeProfile.BaseUrl = entry.BaseUrl
+		result.ExpiresAt = formatTime(entry.ExpiresAt)
+	} else if !strings.Contains(idOrLink, "#") {
+		fatal("Transfer %s is not in the history, please use the link", idOrLink)
+	}
+
+	baseUrl, uuid, key := parseUrl(link)
+	checkAllowedServer(baseUrl)
+	activeProfile.BaseUrl = baseUrl
+	result.TransferId = uuid
+	transferInfo, err := requestDownload(ctx, uuid)
+	if err != nil {
+		var statusErr *HttpStatusError
+		if errors.As(err, &statusErr) && isGoneStatus(statusErr.StatusCode) {
+			result.Expired = true
+			return result
+		}
+		panic(err)
+	}
+	result.Available = true
+	result.Expired = found && entry.expired()
+	result.Transfer = &transferInfo.Transfer
+	metadata := downloadMetadata(ctx, &transferInfo, key)
+	fileInfo := validateFiles(ctx, metadata.Files, transferInfo.DownloadToken)
+	result.Files = decryptFileResults(fileInfo, nil)
+	return result
+}
+
+// The server answers these for transfers that expired or were deleted.
+func isGoneStatus(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+}
+
+func printStatusResult(result *StatusResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Println("Transfer: ", result.TransferId)
+	if !result.Available {
+		fmt.Println("Status:    expired or deleted")
+		return
+	}
+	fmt.Println("Created at: ", result.Transfer.CreatedAt)
+	fmt.Println("Expires in: ", result.Transfer.ExpiresIn)
+	if result.Expired {
+		fmt.Println("Status:    expired")
+	} else {
+		fmt.Println("Status:    available")
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Name", "Size (bytes)", "Downloads", "Remaining"})
+	for _, file := range result.Files {
+		t.AppendRow(table.Row{file.Name, file.Size, file.DownloadCount, file.RemainingDownloads})
+	}
+	t.Render()
+}
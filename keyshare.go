@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Crockford's base32, without the letters that are easily mistaken.
+const codeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Bytes of the SHA-256 hash appended to a code to catch typos.
+const codeChecksumSize = 2
+
+// encodeCode writes data as groups of four base32 characters.
+func encodeCode(data []byte) string {
+	hash := sha256.Sum256(data)
+	data = append(bytes.Clone(data), hash[:codeChecksumSize]...)
+	code := make([]byte, 0)
+	buffer, bits := 0, 0
+	for _, b := range data {
+		buffer = buffer<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			code = append(code, codeAlphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		code = append(code, codeAlphabet[(buffer<<(5-bits))&31])
+	}
+	groups := make([]string, 0)
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, string(code[i:min(i+4, len(code))]))
+	}
+	return strings.Join(groups, "-")
+}
+
+// decodeCode reverses encodeCode. It ignores case, dashes and spaces, and
+// reads O as 0 and I or L as 1.
+func decodeCode(code string) ([]byte, error) {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1").Replace(code)
+	data := make([]byte, 0)
+	buffer, bits := 0, 0
+	for _, c := range code {
+		value := strings.IndexRune(codeAlphabet, c)
+		if value < 0 {
+			return nil, fmt.Errorf("invalid character %q", c)
+		}
+		buffer = buffer<<5 | value
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			data = append(data, byte(buffer>>bits))
+		}
+	}
+	if len(data) <= codeChecksumSize {
+		return nil, errors.New("too short")
+	}
+	data, checksum := data[:len(data)-codeChecksumSize], data[len(data)-codeChecksumSize:]
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:codeChecksumSize], checksum) {
+		return nil, errors.New("wrong checksum, please check for typos")
+	}
+	return data, nil
+}
+
+// Shamir's secret sharing over GF(2^8), byte by byte, with the polynomial of AES.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// multiply by the generator 3
+		x ^= x<<1 ^ byte(int8(x)>>7)&0x1b
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// A share starts with the threshold and its x coordinate, followed by one
+// byte per byte of the secret.
+func splitSecret(secret []byte, threshold int, count int) [][]byte {
+	coefficients := make([]byte, len(secret)*(threshold-1))
+	_, err := rand.Read(coefficients)
+	if err != nil {
+		panic(err)
+	}
+	shares := make([][]byte, 0)
+	for x := 1; x <= count; x++ {
+		share := []byte{byte(threshold), byte(x)}
+		for i, b := range secret {
+			// Horner's method, the secret is the constant term
+			y := byte(0)
+			for j := threshold - 2; j >= 0; j-- {
+				y = gfMul(y, byte(x)) ^ coefficients[i*(threshold-1)+j]
+			}
+			share = append(share, gfMul(y, byte(x))^b)
+		}
+		shares = append(shares, share)
+	}
+	return shares
+}
+
+// combineShares interpolates the secret from at least threshold shares.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	threshold := int(shares[0][0])
+	unique := map[byte][]byte{}
+	for _, share := range shares {
+		if len(share) != len(shares[0]) || int(share[0]) != threshold || share[1] == 0 {
+			return nil, errors.New("the shares belong to different keys")
+		}
+		unique[share[1]] = share
+	}
+	if len(unique) < threshold {
+		return nil, fmt.Errorf("%d shares needed, got %d", threshold, len(unique))
+	}
+	xs := make([]byte, 0)
+	for x := range unique {
+		xs = append(xs, x)
+	}
+	xs = xs[:threshold]
+	secret := make([]byte, len(shares[0])-2)
+	for i := range secret {
+		value := byte(0)
+		for _, xi := range xs {
+			// Lagrange basis polynomial of xi at 0
+			basis := byte(1)
+			for _, xj := range xs {
+				if xj != xi {
+					basis = gfMul(basis, gfDiv(xj, xi^xj))
+				}
+			}
+			value ^= gfMul(unique[xi][i+2], basis)
+		}
+		secret[i] = value
+	}
+	return secret, nil
+}
+
+// parseShareCount reads a "2-of-3" style threshold and count.
+func parseShareCount(value string) (int, int, error) {
+	parts := strings.Split(value, "-of-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("expected <k>-of-<n>, e.g. 2-of-3")
+	}
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if threshold < 2 || threshold > count || count > 255 {
+		return 0, 0, errors.New("k has to be at least 2 and at most n, n at most 255")
+	}
+	return threshold, count, nil
+}
+
+// fragmentKey decodes the key material of a link fragment.
+func fragmentKey(fragment string) []byte {
+	key, err := base64.URLEncoding.DecodeString(strings.ReplaceAll(fragment, ".", "="))
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func keyFragment(key []byte) string {
+	return strings.ReplaceAll(base64.URLEncoding.EncodeToString(key), "=", ".")
+}
+
+// checkSeparateKey validates the key options of encrypt before anything is
+// uploaded.
+func checkSeparateKey(options *Options) {
+	if !options.SeparateKey && !options.KeyCode && options.KeyShares == "" {
+		return
+	}
+	if options.Split {
+		fatal("--split can't be combined with a separate key, the manifest contains the keys")
+	}
+	if (options.KeyCode || options.KeyShares != "") && options.Recipient != "" {
+		fatal("A key for a recipient can't be printed as a code or as shares, use --separate-key")
+	}
+	if options.KeyShares != "" {
+		if _, _, err := parseShareCount(options.KeyShares); err != nil {
+			fatal("Invalid --key-shares %s: %v", options.KeyShares, err)
+		}
+	}
+}
+
+// separateKey moves the key out of the link of result when the options ask
+// for it, into a fragment, a code or shares.
+func separateKey(result *EncryptResult, fragment string, options *Options) {
+	if !options.SeparateKey && !options.KeyCode && options.KeyShares == "" {
+		return
+	}
+	result.Link = strings.TrimSuffix(result.Link, "#"+fragment)
+	switch {
+	case options.KeyShares != "":
+		threshold, count, _ := parseShareCount(options.KeyShares)
+		result.KeyThreshold = threshold
+		result.KeyShares = make([]string, 0)
+		for _, share := range splitSecret(fragmentKey(fragment), threshold, count) {
+			result.KeyShares = append(result.KeyShares, encodeCode(share))
+		}
+	case options.KeyCode:
+		result.Key = encodeCode(fragmentKey(fragment))
+	default:
+		result.Key = fragment
+	}
+}
+
+// parseKey accepts a key as printed by encrypt: the fragment of a link or
+// a code.
+func parseKey(key string) (string, error) {
+	key = strings.TrimPrefix(strings.TrimSpace(key), "#")
+	if isWrappedFragment(key) || strings.HasSuffix(key, ".") {
+		return key, nil
+	}
+	data, err := decodeCode(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) != sha256.Size {
+		return "", errors.New("this is a share, not a key")
+	}
+	return keyFragment(data), nil
+}
+
+func parseShares(codes []string) (string, error) {
+	shares := make([][]byte, 0)
+	for i, code := range codes {
+		share, err := decodeCode(code)
+		if err != nil {
+			return "", fmt.Errorf("share %d: %w", i+1, err)
+		}
+		if len(share) != sha256.Size+2 {
+			return "", fmt.Errorf("share %d is not a share", i+1)
+		}
+		shares = append(shares, share)
+	}
+	key, err := combineShares(shares)
+	if err != nil {
+		return "", err
+	}
+	return keyFragment(key), nil
+}
+
+// completeLink adds the key given with --key or --share to a link without
+// one, or asks for it. Other arguments are returned unchanged.
+func completeLink(link string, options *Options) string {
+	hasKey := options.Key != "" || len(options.Shares) > 0
+	if !strings.Contains(link, "://") {
+		return link
+	}
+	if strings.Contains(link, "#") {
+		if hasKey {
+			fatal("The link already contains a key")
+		}
+		return link
+	}
+	return link + "#" + readKey(options)
+}
+
+// readKey returns the key given with --key or --share, or asks for it.
+func readKey(options *Options) string {
+	var fragment string
+	var err error
+	switch {
+	case options.Key != "":
+		fragment, err = parseKey(options.Key)
+	case len(options.Shares) > 0:
+		fragment, err = parseShares(options.Shares)
+	default:
+		fragment, err = promptKey()
+	}
+	if err != nil {
+		fatal("Invalid key: %v", err)
+	}
+	return fragment
+}
+
+// promptKey reads the key, or enough shares of it, from the terminal.
+func promptKey() (string, error) {
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		fatal("The key is missing, please give it with --key or --share")
+	}
+	fmt.Fprintln(os.Stderr, "Please enter the key or a share:")
+	input, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		panic(err)
+	}
+	data, err := decodeCode(string(input))
+	if err != nil || len(data) != sha256.Size+2 {
+		return parseKey(string(input))
+	}
+	codes := []string{string(input)}
+	for i := 1; i < int(data[0]); i++ {
+		fmt.Fprintf(os.Stderr, "Please enter share %d of %d:\n", i+1, data[0])
+		input, err = term.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			panic(err)
+		}
+		codes = append(codes, string(input))
+	}
+	return parseShares(codes)
+}
+
+func printSeparateKey(result *EncryptResult) {
+	switch {
+	case len(result.KeyShares) > 0:
+		fmt.Printf("Key shares (send them through different channels, any %d of them open the link):\n", result.KeyThreshold)
+		for _, share := range result.KeyShares {
+			fmt.Println(share)
+		}
+	case result.Key != "":
+		fmt.Println("Key (send it through another channel):")
+		fmt.Println(result.Key)
+	}
+}
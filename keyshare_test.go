@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGfMul(t *testing.T) {
+	// The examples of FIPS-197, the field of AES
+	tests := []struct {
+		a, b, want byte
+	}{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x53, 0xca, 0x01},
+		{0x02, 0x80, 0x1b},
+		{0x01, 0xab, 0xab},
+		{0x00, 0xab, 0x00},
+		{0xab, 0x00, 0x00},
+	}
+	for _, test := range tests {
+		if got := gfMul(test.a, test.b); got != test.want {
+			t.Errorf("gfMul(%#x, %#x) = %#x, want %#x", test.a, test.b, got, test.want)
+		}
+		if got := gfMul(test.b, test.a); got != test.want {
+			t.Errorf("gfMul(%#x, %#x) = %#x, want %#x", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestGfDiv(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gfMul(gfDiv(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("gfDiv(%#x, %#x) * %#x = %#x", a, b, b, got)
+			}
+		}
+	}
+}
+
+func TestShamirCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		threshold int
+		count     int
+		use       []int // indexes of the shares that are combined
+		wantErr   string
+	}{
+		{2, 2, []int{0, 1}, ""},
+		{2, 3, []int{0, 2}, ""},
+		{2, 3, []int{2, 1}, ""},
+		{3, 5, []int{4, 0, 2}, ""},
+		{3, 5, []int{0, 1, 2, 3, 4}, ""},
+		{5, 255, []int{254, 100, 3, 17, 42}, ""},
+		{3, 5, []int{0, 1}, "3 shares needed, got 2"},
+		{3, 5, []int{1, 1, 1}, "3 shares needed, got 1"},
+		{2, 3, []int{}, "no shares"},
+	}
+	for _, test := range tests {
+		shares := splitSecret(secret, test.threshold, test.count)
+		if len(shares) != test.count {
+			t.Fatalf("splitSecret(%d of %d) returned %d shares", test.threshold, test.count, len(shares))
+		}
+		used := make([][]byte, 0)
+		for _, i := range test.use {
+			used = append(used, shares[i])
+		}
+		got, err := combineShares(used)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%d of %d with %v: error %v, want %q", test.threshold, test.count, test.use, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("%d of %d with %v = %q, %v, want the secret", test.threshold, test.count, test.use, got, err)
+		}
+	}
+}
+
+func TestShamirSharesOfDifferentKeys(t *testing.T) {
+	a := splitSecret([]byte("first secret"), 2, 3)
+	b := splitSecret([]byte("other secret"), 3, 3)
+	c := splitSecret([]byte("a longer secret"), 2, 3)
+	tests := [][][]byte{
+		{a[0], b[1]},
+		{a[0], c[1]},
+		{a[0], append([]byte{2, 0}, a[1][2:]...)},
+	}
+	for i, shares := range tests {
+		if _, err := combineShares(shares); err == nil {
+			t.Errorf("test %d: combined shares of different keys", i)
+		}
+	}
+}
+
+func TestCodeRoundTrip(t *testing.T) {
+	tests := [][]byte{
+		{0},
+		[]byte("key"),
+		bytes.Repeat([]byte{0xff}, 32),
+		bytes.Repeat([]byte{0x00}, 34),
+	}
+	for _, data := range tests {
+		code := encodeCode(data)
+		for _, typed := range []string{code, strings.ToLower(code), strings.ReplaceAll(code, "-", " ")} {
+			got, err := decodeCode(typed)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("decodeCode(%q) = %x, %v, want %x", typed, got, err, data)
+			}
+		}
+	}
+}
+
+func TestDecodeCode(t *testing.T) {
+	code := encodeCode([]byte{0x00, 0x01, 0x02, 0x03, 0x04})
+	// A different character in the middle of the data, not its padding
+	typo := []byte(code)
+	if typo[2] == 'A' {
+		typo[2] = 'B'
+	} else {
+		typo[2] = 'A'
+	}
+	tests := []struct {
+		code    string
+		wantErr string
+	}{
+		{code, ""},
+		// O is read as 0, I and L as 1
+		{strings.NewReplacer("0", "O", "1", "I").Replace(code), ""},
+		{strings.NewReplacer("0", "o", "1", "l").Replace(code), ""},
+		{string(typo), "wrong checksum, please check for typos"},
+		{code + "U", `invalid character 'U'`},
+		{"0000", "too short"},
+		{"", "too short"},
+	}
+	for _, test := range tests {
+		_, err := decodeCode(test.code)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("decodeCode(%q): %v", test.code, err)
+		}
+		if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("decodeCode(%q): error %v, want %q", test.code, err, test.wantErr)
+		}
+	}
+}
+
+func TestParseShareCount(t *testing.T) {
+	tests := []struct {
+		value     string
+		threshold int
+		count     int
+		ok        bool
+	}{
+		{"2-of-3", 2, 3, true},
+		{"3-of-3", 3, 3, true},
+		{"2-of-255", 2, 255, true},
+		{"1-of-3", 0, 0, false},
+		{"4-of-3", 0, 0, false},
+		{"2-of-256", 0, 0, false},
+		{"2of3", 0, 0, false},
+		{"x-of-3", 0, 0, false},
+		{"2-of-", 0, 0, false},
+	}
+	for _, test := range tests {
+		threshold, count, err := parseShareCount(test.value)
+		if (err == nil) != test.ok || threshold != test.threshold || count != test.count {
+			t.Errorf("parseShareCount(%q) = %d, %d, %v", test.value, threshold, count, err)
+		}
+	}
+}
+
+func TestParseShares(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	codes := make([]string, 0)
+	for _, share := range splitSecret(key, 2, 3) {
+		codes = append(codes, encodeCode(share))
+	}
+	fragment, err := parseShares([]string{codes[2], codes[0]})
+	if err != nil || fragment != keyFragment(key) {
+		t.Errorf("parseShares = %q, %v, want %q", fragment, err, keyFragment(key))
+	}
+	// A key is not a share, and a share is not a key
+	if _, err := parseShares([]string{encodeCode(key)}); err == nil {
+		t.Error("parseShares accepted a key")
+	}
+	if _, err := parseKey(codes[0]); err == nil {
+		t.Error("parseKey accepted a share")
+	}
+}
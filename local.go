@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// An encrypted file of local-encrypt, all numbers are big endian:
+//
+//	header   "SFTLOCAL", uint16 version
+//	chunks   the ciphertext of every chunk, one file after the other
+//	table    uint32 number of chunks, uint32 size of every chunk,
+//	         uint32 size of the metadata, the encrypted metadata
+//	trailer  uint64 offset of the table, "SFTLOCAL"
+//
+// The metadata is the one of a transfer, with the index of the chunk in the
+// table in place of its id. Its key is the key printed by local-encrypt.
+const (
+	localMagic       = "SFTLOCAL"
+	localVersion     = 1
+	localHeaderSize  = len(localMagic) + 2
+	localTrailerSize = 8 + len(localMagic)
+)
+
+type LocalEncryptResult struct {
+	Schema  int                 `json:"schema"`
+	Command string              `json:"command"`
+	File    string              `json:"file"`
+	Key     string              `json:"key"`
+	Files   []EncryptFileResult `json:"files"`
+}
+
+type LocalDecryptResult struct {
+	Schema  int                 `json:"schema"`
+	Command string              `json:"command"`
+	File    string              `json:"file"`
+	Files   []DecryptFileResult `json:"files"`
+}
+
+// localEncrypt writes the files encrypted to options.LocalFile, or to stdout
+// for "-", reading and writing one chunk at a time.
+func localEncrypt(ctx context.Context, files []string, options *Options) LocalEncryptResult {
+	pieces := wholeFiles(files, options)
+	target := options.LocalFile
+	if target == "" {
+		target = filepath.Base(files[0]) + ".enc"
+	}
+	var output io.Writer = os.Stdout
+	completed := false
+	if target == "-" {
+		if outputFormat != OutputText {
+			fatal("-o %s can't be combined with -f -, stdout has the encrypted data", outputFormat)
+		}
+		// Keep the messages out of the encrypted data
+		humanOut = os.Stderr
+	} else {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			fatal("%s already exists, remove it first or choose another file", target)
+		}
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			file.Close()
+			// Never leave a half written file behind
+			if !completed {
+				os.Remove(target)
+			}
+		}()
+		output = file
+	}
+	writer := &countingWriter{writer: output}
+	header := binary.BigEndian.AppendUint16([]byte(localMagic), localVersion)
+	write(writer, header)
+
+	encryptedFiles := make([]UploadedFile, 0)
+	table := make([]uint32, 0)
+	transferProgress := newTransferProgress("Encrypting", "Encrypted", totalFileSize(pieces))
+	for _, piece := range pieces {
+		fileProgress := transferProgress.startFile(piece.Name, piece.Size)
+		input, err := os.Open(piece.Path)
+		if err != nil {
+			panic(err)
+		}
+		chunks := make([]UploadedData, 0)
+		encrypt := func(ctx context.Context, i int) sealedChunk {
+			buffer := make([]byte, min(maxChunkSize, piece.Size-int64(i)*maxChunkSize))
+			_, err := input.ReadAt(buffer, int64(i)*maxChunkSize)
+			if err != nil {
+				panic(err)
+			}
+			cipherText, encryptionData := encryptData(buffer)
+			return sealedChunk{UploadedData{"", keyFragment(encryptionData.KeyMaterial)}, buffer, cipherText}
+		}
+		orderedParallel(ctx, activeProfile.Parallelism, numChunks(piece.Size), encrypt, func(i int, chunk sealedChunk) {
+			write(writer, chunk.cipherText)
+			chunk.data.Uuid = strconv.Itoa(len(table))
+			table = append(table, uint32(len(chunk.cipherText)))
+			chunks = append(chunks, chunk.data)
+			chunkProgress := fileProgress.startChunk(int64(len(chunk.plaintext)))
+			chunkProgress.done(int64(len(chunk.plaintext)))
+		})
+		input.Close()
+		encryptedFiles = append(encryptedFiles, UploadedFile{
+			piece.Name,
+			int(piece.Size),
+			chunks,
+			piece.ContentType,
+			nil,
+		})
+		fileProgress.finish()
+	}
+	transferProgress.finish()
+
+	metadata, err := json.Marshal(Metadata{"", encryptedFiles, nil})
+	if err != nil {
+		panic(err)
+	}
+	cipherText, encryptionData := encryptData(metadata)
+	tableOffset := writer.count
+	buffer := binary.BigEndian.AppendUint32(nil, uint32(len(table)))
+	for _, size := range table {
+		buffer = binary.BigEndian.AppendUint32(buffer, size)
+	}
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(cipherText)))
+	buffer = append(buffer, cipherText...)
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(tableOffset))
+	buffer = append(buffer, localMagic...)
+	write(writer, buffer)
+	completed = true
+
+	result := LocalEncryptResult{
+		Schema:  outputSchemaVersion,
+		Command: "local-encrypt",
+		File:    target,
+		Key:     keyFragment(encryptionData.KeyMaterial),
+		Files:   make([]EncryptFileResult, 0),
+	}
+	for _, file := range encryptedFiles {
+		result.Files = append(result.Files, EncryptFileResult{
+			Name:        file.Name,
+			Size:        file.Size,
+			ContentType: file.FileType,
+			Chunks:      len(file.Chunks),
+		})
+	}
+	return result
+}
+
+func write(w io.Writer, data []byte) {
+	_, err := w.Write(data)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func printLocalEncryptResult(result *LocalEncryptResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	w := os.Stdout
+	if result.File == "-" {
+		// stdout has the encrypted data
+		w = os.Stderr
+	} else {
+		fmt.Fprintln(w, "Successfully encrypted the file(s) into", result.File)
+	}
+	fmt.Fprintln(w, "Key (local-decrypt needs it):")
+	fmt.Fprintln(w, result.Key)
+}
+
+type localChunk struct {
+	offset int64
+	size   int64
+}
+
+// readLocalTable reads the chunk table and the encrypted metadata from the
+// end of an encrypted file.
+func readLocalTable(file *os.File) ([]localChunk, []byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]byte, localHeaderSize)
+	trailer := make([]byte, localTrailerSize)
+	if info.Size() < int64(localHeaderSize+localTrailerSize) {
+		return nil, nil, errors.New("not an encrypted file of local-encrypt")
+	}
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = file.ReadAt(trailer, info.Size()-int64(localTrailerSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(header[:len(localMagic)]) != localMagic || string(trailer[8:]) != localMagic {
+		return nil, nil, errors.New("not an encrypted file of local-encrypt")
+	}
+	if version := binary.BigEndian.Uint16(header[len(localMagic):]); version > localVersion {
+		return nil, nil, fmt.Errorf("version %d is not supported, please update sft", version)
+	}
+	tableOffset := int64(binary.BigEndian.Uint64(trailer))
+	if tableOffset < int64(localHeaderSize) || tableOffset > info.Size()-int64(localTrailerSize) {
+		return nil, nil, errors.New("the file is damaged")
+	}
+	table := make([]byte, info.Size()-int64(localTrailerSize)-tableOffset)
+	_, err = file.ReadAt(table, tableOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bytes.NewReader(table)
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, nil, errors.New("the file is damaged")
+	}
+	chunks := make([]localChunk, 0)
+	offset := int64(localHeaderSize)
+	for i := uint32(0); i < count; i++ {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return nil, nil, errors.New("the file is damaged")
+		}
+		chunks = append(chunks, localChunk{offset, int64(size)})
+		offset += int64(size)
+	}
+	var metadataSize uint32
+	if err := binary.Read(reader, binary.BigEndian, &metadataSize); err != nil || offset != tableOffset || int(metadataSize) != reader.Len() {
+		return nil, nil, errors.New("the file is damaged")
+	}
+	return chunks, table[len(table)-reader.Len():], nil
+}
+
+// localDecrypt writes the files of an encrypted file to the output directory.
+func localDecrypt(ctx context.Context, path string, options *Options) LocalDecryptResult {
+	file, err := os.Open(path)
+	if err != nil {
+		fatal("Could not open the encrypted file: %v", err)
+	}
+	defer file.Close()
+	chunks, encryptedMetadata, err := readLocalTable(file)
+	if err != nil {
+		fatal("Could not read %s: %v", path, err)
+	}
+	metadata, err := openMetadata(encryptedMetadata, fragmentKey(readKey(options)))
+	if err != nil {
+		fatal("The key doesn't open %s", path)
+	}
+	result := LocalDecryptResult{
+		Schema:  outputSchemaVersion,
+		Command: "local-decrypt",
+		File:    path,
+		Files:   make([]DecryptFileResult, 0),
+	}
+	total := int64(0)
+	for _, encryptedFile := range metadata.Files {
+		total += int64(encryptedFile.Size)
+		for _, chunk := range encryptedFile.Chunks {
+			if i, err := strconv.Atoi(chunk.Uuid); err != nil || i < 0 || i >= len(chunks) {
+				fatal("%s is damaged, chunk %s is missing", path, chunk.Uuid)
+			}
+		}
+	}
+	if activeProfile.OutputDir != "" {
+		if err := os.MkdirAll(activeProfile.OutputDir, 0755); err != nil {
+			fatal("Could not create the output directory: %v", err)
+		}
+	}
+	transferProgress := newTransferProgress("Decrypting", "Decrypted", total)
+	for _, encryptedFile := range metadata.Files {
+		target := localDecryptFile(ctx, file, chunks, &encryptedFile, transferProgress)
+		result.Files = append(result.Files, DecryptFileResult{
+			Name:        encryptedFile.Name,
+			Size:        encryptedFile.Size,
+			ContentType: encryptedFile.FileType,
+			Chunks:      len(encryptedFile.Chunks),
+			Path:        target,
+		})
+	}
+	transferProgress.finish()
+	return result
+}
+
+func localDecryptFile(ctx context.Context, file *os.File, chunks []localChunk, encryptedFile *UploadedFile, transferProgress *TransferProgress) string {
+	// The name comes from whoever encrypted the file, keep it in the output directory
+	name := filepath.Join(activeProfile.OutputDir, filepath.Base(encryptedFile.Name))
+	target := findNameForFile(name)
+	if target != name {
+		printStatus("Saving %s as %s", encryptedFile.Name, target)
+	}
+	fileProgress := transferProgress.startFile(target, int64(encryptedFile.Size))
+	output, err := os.Create(target)
+	if err != nil {
+		fatal("Could not create %s: %v", target, err)
+	}
+	completed := false
+	defer func() {
+		output.Close()
+		// Never leave a half written file behind
+		if !completed {
+			os.Remove(target)
+		}
+	}()
+	type decryptedChunk struct {
+		plaintext []byte
+		err       error
+	}
+	decrypt := func(ctx context.Context, i int) decryptedChunk {
+		chunk := encryptedFile.Chunks[i]
+		index, _ := strconv.Atoi(chunk.Uuid)
+		cipherText := make([]byte, chunks[index].size)
+		_, err := file.ReadAt(cipherText, chunks[index].offset)
+		if err != nil {
+			panic(err)
+		}
+		plaintext, err := openChunk(cipherText, fragmentKey(chunk.Secret))
+		if err == nil {
+			chunkProgress := fileProgress.startChunk(int64(len(plaintext)))
+			chunkProgress.done(int64(len(plaintext)))
+		}
+		return decryptedChunk{plaintext, err}
+	}
+	orderedParallel(ctx, activeProfile.Parallelism, len(encryptedFile.Chunks), decrypt, func(i int, chunk decryptedChunk) {
+		if chunk.err != nil {
+			output.Close()
+			os.Remove(target)
+			fatal("%s is damaged, chunk %d of %s doesn't decrypt", file.Name(), i+1, encryptedFile.Name)
+		}
+		write(output, chunk.plaintext)
+	})
+	completed = true
+	fileProgress.finish()
+	return target
+}
+
+func printLocalDecryptResult(result *LocalDecryptResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	for _, file := range result.Files {
+		fmt.Println("Decrypted", file.Path)
+	}
+}
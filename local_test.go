@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// localContainer holds the parts of an encrypted file of local-encrypt, so a
+// test can damage one before they are written.
+type localContainer struct {
+	header   []byte
+	chunks   []byte
+	table    []byte
+	trailer  []byte
+	metadata []byte
+}
+
+func newLocalContainer(sizes ...uint32) *localContainer {
+	c := &localContainer{
+		header:   binary.BigEndian.AppendUint16([]byte(localMagic), localVersion),
+		chunks:   make([]byte, 0),
+		metadata: []byte("encrypted metadata"),
+	}
+	c.table = binary.BigEndian.AppendUint32(nil, uint32(len(sizes)))
+	for _, size := range sizes {
+		c.chunks = append(c.chunks, bytes.Repeat([]byte{0xaa}, int(size))...)
+		c.table = binary.BigEndian.AppendUint32(c.table, size)
+	}
+	c.table = binary.BigEndian.AppendUint32(c.table, uint32(len(c.metadata)))
+	c.table = append(c.table, c.metadata...)
+	c.trailer = binary.BigEndian.AppendUint64(nil, uint64(len(c.header)+len(c.chunks)))
+	c.trailer = append(c.trailer, localMagic...)
+	return c
+}
+
+func (c *localContainer) write(t *testing.T) *os.File {
+	t.Helper()
+	data := bytes.Join([][]byte{c.header, c.chunks, c.table, c.trailer}, nil)
+	path := filepath.Join(t.TempDir(), "file.sft")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestReadLocalTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []uint32
+		want  []localChunk
+	}{
+		{"no chunks", nil, []localChunk{}},
+		{"one chunk", []uint32{100}, []localChunk{{10, 100}}},
+		{"chunks", []uint32{100, 50, 7}, []localChunk{{10, 100}, {110, 50}, {160, 7}}},
+	}
+	for _, test := range tests {
+		c := newLocalContainer(test.sizes...)
+		chunks, metadata, err := readLocalTable(c.write(t))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(chunks, test.want) {
+			t.Errorf("%s: chunks %v, want %v", test.name, chunks, test.want)
+		}
+		if !bytes.Equal(metadata, c.metadata) {
+			t.Errorf("%s: metadata %q, want %q", test.name, metadata, c.metadata)
+		}
+	}
+}
+
+func TestReadLocalTableDamaged(t *testing.T) {
+	const notLocal = "not an encrypted file of local-encrypt"
+	const damaged = "the file is damaged"
+	tests := []struct {
+		name    string
+		edit    func(c *localContainer)
+		wantErr string
+	}{
+		{"too short", func(c *localContainer) {
+			c.chunks, c.table, c.trailer = nil, nil, []byte("SFTLOCAL")
+		}, notLocal},
+		{"bad header", func(c *localContainer) { c.header[0] = 'X' }, notLocal},
+		{"bad trailer", func(c *localContainer) { c.trailer[len(c.trailer)-1] = 'X' }, notLocal},
+		{"newer version", func(c *localContainer) {
+			binary.BigEndian.PutUint16(c.header[len(localMagic):], localVersion+1)
+		}, "version 2 is not supported, please update sft"},
+		{"table before the chunks", func(c *localContainer) {
+			binary.BigEndian.PutUint64(c.trailer, 2)
+		}, damaged},
+		{"table after the end", func(c *localContainer) {
+			binary.BigEndian.PutUint64(c.trailer, 1<<40)
+		}, damaged},
+		{"chunks don't end at the table", func(c *localContainer) {
+			binary.BigEndian.PutUint32(c.table[4:], 99)
+		}, damaged},
+		{"too many chunks", func(c *localContainer) {
+			binary.BigEndian.PutUint32(c.table, 1000)
+		}, damaged},
+		{"metadata size", func(c *localContainer) {
+			binary.BigEndian.PutUint32(c.table[12:], uint32(len(c.metadata)+1))
+		}, damaged},
+		{"truncated table", func(c *localContainer) {
+			c.table = c.table[:2]
+			binary.BigEndian.PutUint64(c.trailer, uint64(len(c.header)+len(c.chunks)))
+		}, damaged},
+	}
+	for _, test := range tests {
+		c := newLocalContainer(100, 50)
+		test.edit(c)
+		_, _, err := readLocalTable(c.write(t))
+		if err == nil || err.Error() != test.wantErr {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LogText = "text"
+	LogJson = "json"
+)
+
+// Bodies up to this size are logged with -vv, bigger ones only by size.
+const maxLoggedBody = 64 << 10
+
+// logger gets the API calls with -v (info) and -vv (debug), it discards
+// everything otherwise.
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Values of these JSON fields, form fields and headers never reach the log.
+var secretFields = regexp.MustCompile(`(?i)("(?:transfer_management_token|management_token|download_token|encryptionRawSecret|password|token)"\s*:\s*)"[^"]*"`)
+var secretFormFields = regexp.MustCompile(`(?i)((?:transfer_management_token|management_token|download_token|encryptionRawSecret|password)=)[^&\s]*`)
+var secretHeaders = regexp.MustCompile(`(?i)token|secret|password|authorization|cookie|key`)
+
+// The key of a link is its fragment.
+var linkFragment = regexp.MustCompile(`(https?://[^\s"#]*)#[^\s"]+`)
+
+// redact removes the secrets from a request or response body, a URL or an
+// error message.
+func redact(text string) string {
+	text = secretFields.ReplaceAllString(text, `$1"[redacted]"`)
+	text = secretFormFields.ReplaceAllString(text, `$1[redacted]`)
+	return linkFragment.ReplaceAllString(text, `$1#[redacted]`)
+}
+
+// logEndpoint returns the path of an API call. Other addresses, like those of
+// webhooks, can have a secret in the path and are logged by their host.
+func logEndpoint(address *url.URL) string {
+	if strings.HasPrefix(address.Path, "/api/") {
+		return address.Path
+	}
+	return address.Host + "/[redacted]"
+}
+
+func logUrl(address *url.URL) string {
+	if strings.HasPrefix(address.Path, "/api/") {
+		return redact(address.String())
+	}
+	return address.Scheme + "://" + logEndpoint(address)
+}
+
+// redactError redacts an error for the log. The errors of net/http contain
+// the whole address of the request, it is shortened like by logUrl.
+func redactError(err error) string {
+	text := err.Error()
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if address, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			shown := logUrl(address)
+			text = strings.ReplaceAll(text, strconv.Quote(urlErr.URL), strconv.Quote(shown))
+			text = strings.ReplaceAll(text, urlErr.URL, shown)
+		}
+	}
+	return redact(text)
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if secretHeaders.MatchString(name) {
+			value = "[redacted]"
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+func isValidLogFormat(format string) bool {
+	return format == "" || format == LogText || format == LogJson
+}
+
+// setupLogging sends the log to stderr or --log-file. A log file gets the
+// API calls even without -v.
+func setupLogging(options *Options) error {
+	if options.Verbosity == 0 && options.LogOutput == "" {
+		return nil
+	}
+	var output io.Writer = os.Stderr
+	if options.LogOutput != "" {
+		file, err := os.OpenFile(options.LogOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	level := slog.LevelInfo
+	if options.Verbosity > 1 {
+		level = slog.LevelDebug
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	if options.LogFormat == LogJson {
+		logger = slog.New(slog.NewJSONHandler(output, handlerOptions))
+	} else {
+		logger = slog.New(slog.NewTextHandler(output, handlerOptions))
+	}
+	http.DefaultClient.Transport = &loggingTransport{http.DefaultTransport}
+	return nil
+}
+
+// loggingTransport logs every request once its response body is closed,
+// when the number of received bytes is known.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	debug := logger.Enabled(request.Context(), slog.LevelDebug)
+	if debug {
+		logger.Debug("request",
+			"method", request.Method,
+			"url", logUrl(request.URL),
+			"headers", redactHeaders(request.Header),
+			"body", requestBody(request))
+	}
+	start := time.Now()
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		logger.Info("api call",
+			"method", request.Method,
+			"endpoint", logEndpoint(request.URL),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"sent", max(request.ContentLength, 0),
+			"error", redactError(err))
+		return nil, err
+	}
+	if debug {
+		logger.Debug("response",
+			"status", response.StatusCode,
+			"headers", redactHeaders(response.Header),
+			"body", peekBody(&response.Body, response.Header.Get("Content-Type"), response.ContentLength))
+	}
+	response.Body = &loggedBody{ReadCloser: response.Body, request: request, status: response.StatusCode, start: start}
+	return response, nil
+}
+
+func isLoggedBody(contentType string, length int64) bool {
+	textual := strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/")
+	return textual && length >= 0 && length <= maxLoggedBody
+}
+
+// requestBody returns the redacted body of a request for the log, from a
+// copy as a RoundTripper must not touch the request. Binary and big bodies
+// are described by their size.
+func requestBody(request *http.Request) string {
+	if request.Body == nil || request.Body == http.NoBody {
+		return ""
+	}
+	contentType := request.Header.Get("Content-Type")
+	if !isLoggedBody(contentType, request.ContentLength) || request.GetBody == nil {
+		return fmt.Sprintf("[%d bytes of %s]", request.ContentLength, contentType)
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	return redact(string(data))
+}
+
+// peekBody returns the redacted body of a response for the log and puts it
+// back.
+func peekBody(body *io.ReadCloser, contentType string, length int64) string {
+	if *body == nil || *body == http.NoBody {
+		return ""
+	}
+	if !isLoggedBody(contentType, length) {
+		return fmt.Sprintf("[%d bytes of %s]", length, contentType)
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(io.MultiReader(bytes.NewReader(data), errorReader{err}))
+	return redact(string(data))
+}
+
+// errorReader passes on the error of reading a body for the log.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+type loggedBody struct {
+	io.ReadCloser
+	request  *http.Request
+	status   int
+	start    time.Time
+	received int64
+	logged   bool
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.received += int64(n)
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	if !b.logged {
+		b.logged = true
+		logger.Info("api call",
+			"method", b.request.Method,
+			"endpoint", logEndpoint(b.request.URL),
+			"status", b.status,
+			"duration_ms", time.Since(b.start).Milliseconds(),
+			"sent", max(b.request.ContentLength, 0),
+			"received", b.received)
+	}
+	return b.ReadCloser.Close()
+}
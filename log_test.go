@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{"id": "abc", "size": 3}`, `{"id": "abc", "size": 3}`},
+		{`{"transfer_management_token": "secret1", "id": "abc"}`, `{"transfer_management_token": "[redacted]", "id": "abc"}`},
+		{`{"Password":"hunter2"}`, `{"Password":"[redacted]"}`},
+		{`{"download_token" : "t"}`, `{"download_token" : "[redacted]"}`},
+		{`password=hunter2&name=a`, `password=[redacted]&name=a`},
+		{`encryptionRawSecret=abc def`, `encryptionRawSecret=[redacted] def`},
+		{`https://sft.example.com/d/abc#key123`, `https://sft.example.com/d/abc#[redacted]`},
+		{`see "https://sft.example.com/d/abc#key123" now`, `see "https://sft.example.com/d/abc#[redacted]" now`},
+	}
+	for _, test := range tests {
+		if got := redact(test.text); got != test.want {
+			t.Errorf("redact(%s) = %s, want %s", test.text, got, test.want)
+		}
+	}
+}
+
+func TestLogUrl(t *testing.T) {
+	tests := []struct {
+		address  string
+		endpoint string
+		url      string
+	}{
+		{"https://sft.example.com/api/v1/upload/info/", "/api/v1/upload/info/", "https://sft.example.com/api/v1/upload/info/"},
+		{"https://sft.example.com/api/v1/download/abc#key", "/api/v1/download/abc", "https://sft.example.com/api/v1/download/abc#[redacted]"},
+		{"https://hooks.example.com/services/T00/B00/XXXX", "hooks.example.com/[redacted]", "https://hooks.example.com/[redacted]"},
+	}
+	for _, test := range tests {
+		address, err := url.Parse(test.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := logEndpoint(address); got != test.endpoint {
+			t.Errorf("logEndpoint(%s) = %s, want %s", test.address, got, test.endpoint)
+		}
+		if got := logUrl(address); got != test.url {
+			t.Errorf("logUrl(%s) = %s, want %s", test.address, got, test.url)
+		}
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	refused := errors.New("connection refused")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{
+			err:  &url.Error{Op: "Post", URL: "https://hooks.example.com/services/T00/B00/XXXX", Err: refused},
+			want: `Post "https://hooks.example.com/[redacted]": connection refused`,
+		},
+		{
+			err:  &url.Error{Op: "Get", URL: "https://sft.example.com/api/v1/upload/info/", Err: refused},
+			want: `Get "https://sft.example.com/api/v1/upload/info/": connection refused`,
+		},
+		{
+			err:  errors.New(`upload failed: {"password": "hunter2"}`),
+			want: `upload failed: {"password": "[redacted]"}`,
+		},
+	}
+	for _, test := range tests {
+		if got := redactError(test.err); got != test.want {
+			t.Errorf("redactError(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Authorization", "Bearer abc")
+	header.Set("X-Api-Key", "abc")
+	header.Set("Set-Cookie", "session=abc")
+	header.Add("Accept", "text/plain")
+	header.Add("Accept", "application/json")
+	want := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "[redacted]",
+		"X-Api-Key":     "[redacted]",
+		"Set-Cookie":    "[redacted]",
+		"Accept":        "text/plain, application/json",
+	}
+	got := redactHeaders(header)
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("redactHeaders: %s = %q, want %q", name, got[name], value)
+		}
+	}
+	for name, value := range got {
+		if strings.Contains(value, "abc") {
+			t.Errorf("redactHeaders: %s = %q", name, value)
+		}
+	}
+}
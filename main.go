@@ -1,100 +1,467 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
-func printUsageAndExit(exitCode int) {
-	fmt.Println("Usage:")
-	fmt.Println("    Help:")
-	fmt.Println("        sft -h")
-	fmt.Println("    Encryption:")
-	fmt.Println("        sft <options> encrypt <file> ...")
-	fmt.Println("        Options:")
-	fmt.Println("            -p    set password (rarely needed)")
-	fmt.Println("")
-	fmt.Println("    Decryption:")
-	fmt.Println("        sft <options> decrypt https://filetransfer.kpn.com/download/<uuid>#<base64key>")
-	fmt.Println("        Options:")
-	fmt.Println("            -s    show the list of files (do not download them) and exit")
-	os.Exit(exitCode)
-}
+// The signal that cancelled the context of the command.
+var interruptSignal os.Signal
+
+var commands []*Command
 
-func parseOptions() ([]string, Options) {
-	fmt.Println("")
-	var options = Options{}
-	i := 0
-	var arg string
-	for i, arg = range os.Args[1:] {
-		if len(arg) != 2 {
-			return os.Args[1+i:], options
-		}
-
-		if arg[0] == '-' {
-			switch arg[1] {
-			case 'p':
-				{
-					options.Password = true
+func init() {
+	// Assigned in init, the help and completion commands refer to the list
+	commands = []*Command{
+		{
+			Name:      "encrypt",
+			Summary:   "Encrypt and upload files, prints the download link",
+			Arguments: "<file>...",
+			MinArgs:   1,
+			MaxArgs:   -1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.BoolFlag(&options.Password, "password", "p", "set password (rarely needed)")
+				flags.BoolFlag(&options.DeleteOnCancel, "cleanup", "c", "delete the incomplete transfer from the server when interrupted")
+				flags.StringFlag(&options.ProfileFlags.DeleteAfter, "delete-after", "", "<period>", "delete the transfer after this period, e.g. 7d")
+				flags.IntFlag(&options.ProfileFlags.DeleteAfterCount, "download-limit", "", "<n>", "delete the transfer after n downloads")
+				flags.BoolFlag(&options.NoHistory, "no-history", "", "do not save the transfer in the local history")
+				flags.BoolFlag(&options.IgnorePolicy, "ignore-policy", "", "upload files the content policy denies, except for mandatory rules")
+				flags.BoolFlag(&options.Split, "split", "", "upload files over the size limit as several transfers")
+				flags.StringFlag(&options.Manifest, "manifest", "", "<file>", "with --split, write the manifest of the transfers to this file")
+				flags.StringFlag(&options.Recipient, "recipient", "", "<key>", "only the owner of this public key (see 'sft keygen') can use the link")
+				flags.StringFlag(&options.Recipients, "recipients", "", "<n|labels>", "upload once into n transfers, or one per label: name[:period[:downloads]],...")
+				flags.BoolFlag(&options.SeparateKey, "separate-key", "", "print the link without the key and the key separately")
+				flags.BoolFlag(&options.KeyCode, "key-code", "", "print the key separately as a code that is easy to type")
+				flags.StringFlag(&options.KeyShares, "key-shares", "", "<k>-of-<n>", "print the key separately as n shares, any k of them open the link")
+				flags.StringFlag(&options.ChecksumAlgorithm, "checksum", "", "<algorithm>", "checksum of the files, sha256 (default) or blake2b")
+				flags.BoolFlag(&options.EmbedChecksums, "embed-checksums", "", "put the checksums in the encrypted metadata, decrypt verifies them")
+				flags.StringFlag(&options.ProfileFlags.SignKey, "sign-key", "", "<file>", "sign the metadata with this key (see 'sft keygen --sign')")
+				webhookFlags(flags, options)
+				transferFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				encryptFiles(ctx, args, options)
+			},
+		},
+		{
+			Name:      "watch",
+			Summary:   "Upload the files that appear in a directory, until stopped",
+			Arguments: "<dir>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.DurationFlag(&options.Settle, "settle", "", "<duration>", "take a file once it didn't change for this long (default 5s)")
+				flags.DurationFlag(&options.PollInterval, "poll", "", "<duration>", "check the directory this often without inotify (default 10s)")
+				flags.BoolFlag(&options.IgnorePolicy, "ignore-policy", "", "upload files the content policy denies, except for mandatory rules")
+				flags.BoolFlag(&options.Batch, "batch", "", "upload the files that settled together as one transfer")
+				flags.StringFlag(&options.DoneDir, "done", "", "<dir>", "move uploaded files here (default <dir>/done)")
+				flags.StringFlag(&options.FailedDir, "failed", "", "<dir>", "move files that could not be uploaded here (default <dir>/failed)")
+				flags.BoolFlag(&options.LinkFiles, "link-file", "", "write the link next to every uploaded file as <file>.link")
+				flags.StringFlag(&options.LogFile, "log", "", "<file>", "append a JSON line with the link or the error of every upload")
+				flags.StringFlag(&options.ProfileFlags.DeleteAfter, "delete-after", "", "<period>", "delete the transfers after this period, e.g. 7d")
+				flags.IntFlag(&options.ProfileFlags.DeleteAfterCount, "download-limit", "", "<n>", "delete the transfers after n downloads")
+				flags.BoolFlag(&options.NoHistory, "no-history", "", "do not save the transfers in the local history")
+				flags.StringFlag(&options.Recipient, "recipient", "", "<key>", "only the owner of this public key (see 'sft keygen') can use the links")
+				flags.StringFlag(&options.ChecksumAlgorithm, "checksum", "", "<algorithm>", "checksum of the files, sha256 (default) or blake2b")
+				flags.BoolFlag(&options.EmbedChecksums, "embed-checksums", "", "put the checksums in the encrypted metadata, decrypt verifies them")
+				flags.StringFlag(&options.ProfileFlags.SignKey, "sign-key", "", "<file>", "sign the metadata with this key (see 'sft keygen --sign')")
+				webhookFlags(flags, options)
+				transferFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				watchFolder(ctx, args[0], options)
+			},
+		},
+		{
+			Name:      "reshare",
+			Summary:   "Copy the files of a link into a new transfer with new keys and limits, prints the new link",
+			Arguments: defaultBaseUrl + "/download/<uuid>#<base64key>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				identityFlag(flags, options)
+				keyFlags(flags, options)
+				flags.StringFlag(&options.Description, "description", "", "<text>", "description of the new transfer (default the one of the link)")
+				flags.BoolFlag(&options.Password, "password", "p", "set password (rarely needed)")
+				flags.BoolFlag(&options.DeleteOnCancel, "cleanup", "c", "delete the incomplete transfer from the server when interrupted")
+				flags.StringFlag(&options.ProfileFlags.DeleteAfter, "delete-after", "", "<period>", "delete the new transfer after this period, e.g. 7d")
+				flags.IntFlag(&options.ProfileFlags.DeleteAfterCount, "download-limit", "", "<n>", "delete the new transfer after n downloads")
+				flags.BoolFlag(&options.NoHistory, "no-history", "", "do not save the transfer in the local history")
+				flags.StringFlag(&options.Recipient, "recipient", "", "<key>", "only the owner of this public key (see 'sft keygen') can use the new link")
+				flags.BoolFlag(&options.SeparateKey, "separate-key", "", "print the link without the key and the key separately")
+				flags.BoolFlag(&options.KeyCode, "key-code", "", "print the key separately as a code that is easy to type")
+				flags.StringFlag(&options.KeyShares, "key-shares", "", "<k>-of-<n>", "print the key separately as n shares, any k of them open the link")
+				flags.StringFlag(&options.ChecksumAlgorithm, "checksum", "", "<algorithm>", "checksum of the files, sha256 (default) or blake2b")
+				flags.BoolFlag(&options.EmbedChecksums, "embed-checksums", "", "put the checksums in the encrypted metadata, decrypt verifies them")
+				flags.StringFlag(&options.ProfileFlags.SignKey, "sign-key", "", "<file>", "sign the metadata with this key (see 'sft keygen --sign')")
+				flags.StringListFlag(&options.ProfileFlags.Trust, "trust", "", "<key|file>", "only accept a link signed by this key or the keys in this file, repeatable")
+				flags.BoolFlag(&options.IgnorePolicy, "ignore-policy", "", "upload files the content policy denies, except for mandatory rules")
+				webhookFlags(flags, options)
+				transferFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := reshareTransfer(ctx, completeLink(args[0], options), options)
+				printEncryptResult(&result)
+			},
+		},
+		{
+			Name:      "seal",
+			Summary:   "Encrypt files into a bundle without uploading them, 'sft publish' uploads it later",
+			Arguments: "<file>...",
+			MinArgs:   1,
+			MaxArgs:   -1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.StringFlag(&options.Bundle, "bundle", "b", "<file>", "write the bundle to this file (default bundle.sft)")
+				flags.BoolFlag(&options.IgnorePolicy, "ignore-policy", "", "upload files the content policy denies, except for mandatory rules")
+				flags.StringFlag(&options.ChecksumAlgorithm, "checksum", "", "<algorithm>", "checksum of the files, sha256 (default) or blake2b")
+				flags.BoolFlag(&options.EmbedChecksums, "embed-checksums", "", "put the checksums in the encrypted metadata, decrypt verifies them")
+				flags.IntFlag(&options.ProfileFlags.Parallelism, "parallel", "j", "<n>", "encrypt n chunks at the same time")
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := sealFiles(ctx, args, options)
+				printSealResult(&result)
+			},
+		},
+		{
+			Name:      "publish",
+			Summary:   "Upload a bundle created by 'sft seal', prints the download link",
+			Arguments: "<bundle>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				keyFlags(flags, options)
+				flags.BoolFlag(&options.Password, "password", "p", "set password (rarely needed)")
+				flags.BoolFlag(&options.DeleteOnCancel, "cleanup", "c", "delete the incomplete transfer from the server when interrupted")
+				flags.StringFlag(&options.ProfileFlags.DeleteAfter, "delete-after", "", "<period>", "delete the transfer after this period, e.g. 7d")
+				flags.IntFlag(&options.ProfileFlags.DeleteAfterCount, "download-limit", "", "<n>", "delete the transfer after n downloads")
+				flags.BoolFlag(&options.NoHistory, "no-history", "", "do not save the transfer in the local history")
+				flags.StringFlag(&options.Recipient, "recipient", "", "<key>", "only the owner of this public key (see 'sft keygen') can use the link")
+				flags.BoolFlag(&options.SeparateKey, "separate-key", "", "print the link without the key and the key separately")
+				flags.BoolFlag(&options.KeyCode, "key-code", "", "print the key separately as a code that is easy to type")
+				flags.StringFlag(&options.KeyShares, "key-shares", "", "<k>-of-<n>", "print the key separately as n shares, any k of them open the link")
+				flags.StringFlag(&options.ProfileFlags.SignKey, "sign-key", "", "<file>", "sign the metadata with this key (see 'sft keygen --sign')")
+				flags.BoolFlag(&options.IgnorePolicy, "ignore-policy", "", "upload files the content policy denies, except for mandatory rules")
+				webhookFlags(flags, options)
+				transferFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := publishBundle(ctx, args[0], options)
+				printEncryptResult(&result)
+			},
+		},
+		{
+			Name:      "local-encrypt",
+			Summary:   "Encrypt files into a local file in the format of the transfers, without the server",
+			Arguments: "<file>...",
+			MinArgs:   1,
+			MaxArgs:   -1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.StringFlag(&options.LocalFile, "file", "f", "<file>", "write to this file, - for stdout (default <first file>.enc)")
+				flags.IntFlag(&options.ProfileFlags.Parallelism, "parallel", "j", "<n>", "encrypt n chunks at the same time")
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := localEncrypt(ctx, args, options)
+				printLocalEncryptResult(&result)
+			},
+		},
+		{
+			Name:      "local-decrypt",
+			Summary:   "Decrypt a file created by 'sft local-encrypt'",
+			Arguments: "<file>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				keyFlags(flags, options)
+				flags.StringFlag(&options.ProfileFlags.OutputDir, "output-dir", "d", "<dir>", "save the files in this directory")
+				flags.IntFlag(&options.ProfileFlags.Parallelism, "parallel", "j", "<n>", "decrypt n chunks at the same time")
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := localDecrypt(ctx, args[0], options)
+				printLocalDecryptResult(&result)
+			},
+		},
+		{
+			Name:      "decrypt",
+			Summary:   "Download and decrypt the files of a link or of a split manifest",
+			Arguments: defaultBaseUrl + "/download/<uuid>#<base64key> | <manifest>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.BoolFlag(&options.Show, "show", "s", "show the list of files (do not download them) and exit")
+				flags.StringFlag(&options.ProfileFlags.OutputDir, "output-dir", "d", "<dir>", "save the files in this directory")
+				identityFlag(flags, options)
+				keyFlags(flags, options)
+				flags.StringFlag(&options.ChecksumFile, "checksums", "", "<file>", "verify the files against a sha256sum or b2sum file")
+				flags.BoolFlag(&options.WriteChecksum, "write-checksum", "", "write a .sha256 file next to every downloaded file")
+				flags.StringListFlag(&options.ProfileFlags.Trust, "trust", "", "<key|file>", "only accept transfers signed by this key or the keys in this file, repeatable")
+				flags.StringFlag(&options.ProfileFlags.ScanCommand, "scan-command", "", "<command>", "run this command with every downloaded file, a non-zero exit quarantines it")
+				flags.StringFlag(&options.ProfileFlags.Clamd, "clamd", "", "<socket|host:port>", "scan every downloaded file with clamd")
+				flags.StringFlag(&options.ProfileFlags.QuarantineDir, "quarantine", "", "<dir>", "move files that fail the scan here (default <output-dir>/quarantine)")
+				webhookFlags(flags, options)
+				transferFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				if isManifest(args[0]) {
+					result := decryptManifest(ctx, args[0], options)
+					emitResult(&result)
+					exitOnRejectedFiles(result.Files)
+					return
 				}
-			case 's':
-				{
-					options.Show = true
+				result := decryptFromUrl(ctx, completeLink(args[0], options), options)
+				emitResult(&result)
+				exitOnRejectedFiles(result.Files)
+			},
+		},
+		{
+			Name:      "history",
+			Summary:   "List the transfers created on this machine",
+			Arguments: "",
+			MinArgs:   0,
+			MaxArgs:   0,
+			Flags: func(flags *FlagSet, options *Options) {
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				printHistory()
+			},
+		},
+		{
+			Name:      "status",
+			Summary:   "Show the remaining downloads of a transfer",
+			Arguments: "<id|link>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				identityFlag(flags, options)
+				keyFlags(flags, options)
+				networkFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := transferStatus(ctx, completeLink(args[0], options))
+				printStatusResult(&result)
+			},
+		},
+		{
+			Name:      "revoke",
+			Summary:   "Delete a transfer from the server, its link stops working",
+			Arguments: "<token|id|link>",
+			MinArgs:   1,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.BoolFlag(&options.Yes, "yes", "y", "do not ask for confirmation")
+				networkFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := revokeTransfer(ctx, args[0], options)
+				printRevokeResult(&result)
+			},
+		},
+		{
+			Name:      "doctor",
+			Summary:   "Check the configuration, the connection to the server and the temp directory",
+			Arguments: "",
+			MinArgs:   0,
+			MaxArgs:   0,
+			Flags: func(flags *FlagSet, options *Options) {
+				networkFlags(flags, options)
+				logFlags(flags, options)
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				result := runDoctor(ctx, options)
+				printDoctorResult(&result)
+				exitOnFailedChecks(&result)
+			},
+		},
+		{
+			Name:      "keygen",
+			Summary:   "Create a key pair for receiving links encrypted with --recipient or for signing",
+			Arguments: "[file]",
+			MinArgs:   0,
+			MaxArgs:   1,
+			Flags: func(flags *FlagSet, options *Options) {
+				flags.BoolFlag(&options.SigningKey, "sign", "", "create a key for encrypt --sign-key (default file ~/.config/sft/signing-key)")
+				flags.StringFlag(&options.SignerName, "name", "", "<name>", "with --sign, the name shown to the recipients")
+				outputFlag(flags, options)
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				path := ""
+				if len(args) > 0 {
+					path = args[0]
 				}
-			case 'h':
-				{
-					options.Help = true
+				if options.SigningKey {
+					result := generateSigningKey(path, options.SignerName)
+					printSigningKeygenResult(&result)
+					return
 				}
-			default:
-				{
-					fmt.Println("Unknown argument", arg)
-					printUsageAndExit(1)
+				result := generateIdentity(path)
+				printKeygenResult(&result)
+			},
+		},
+		{
+			Name:      "completion",
+			Summary:   "Print the shell completion script for bash, zsh or fish",
+			Arguments: "bash|zsh|fish",
+			MinArgs:   1,
+			MaxArgs:   1,
+			ArgumentValues: func() []string {
+				return []string{"bash", "zsh", "fish"}
+			},
+			Run: func(ctx context.Context, args []string, options *Options) {
+				printCompletion(args[0])
+			},
+		},
+		{
+			Name:           "help",
+			Summary:        "Show the help of a command",
+			Arguments:      "[command]",
+			MinArgs:        0,
+			MaxArgs:        1,
+			ArgumentValues: commandNames,
+			Run: func(ctx context.Context, args []string, options *Options) {
+				if len(args) == 0 {
+					printUsage(os.Stdout)
+					return
 				}
-			}
-		} else {
-			break
-		}
+				command := findCommand(args[0])
+				if command == nil {
+					usageError(nil, "Unknown command: %s", args[0])
+				}
+				printCommandHelp(os.Stdout, command)
+			},
+		},
 	}
-	return os.Args[1+i:], options
 }
 
-func parseMode(rem []string, options *Options) (encrypt bool, f []string) {
-	if len(rem) < 2 {
-		fmt.Println("Too few arguments")
-		printUsageAndExit(1)
-	}
+// networkFlags select the server and how to reach it, every command that
+// talks to a server has them.
+func networkFlags(flags *FlagSet, options *Options) {
+	flags.StringFlag(&options.Profile, "profile", "", "<name>", "use this profile of the config file (default $SFT_PROFILE)")
+	flags.StringFlag(&options.ProfileFlags.BaseUrl, "base-url", "", "<url>", "server to use instead of the one of the profile")
+	flags.StringFlag(&options.ProfileFlags.Proxy, "proxy", "", "<url>", "send requests through this proxy")
+}
+
+// transferFlags are the flags of the commands that upload or download chunks.
+func transferFlags(flags *FlagSet, options *Options) {
+	networkFlags(flags, options)
+	flags.IntFlag(&options.ProfileFlags.Parallelism, "parallel", "j", "<n>", "transfer n chunks at the same time")
+}
+
+func identityFlag(flags *FlagSet, options *Options) {
+	flags.StringFlag(&options.ProfileFlags.Identity, "identity", "i", "<file>", "private key for links encrypted for a recipient (default ~/.config/sft/identity)")
+}
+
+func keyFlags(flags *FlagSet, options *Options) {
+	flags.StringFlag(&options.Key, "key", "k", "<key>", "key of a link printed without one")
+	flags.StringListFlag(&options.Shares, "share", "", "<share>", "key share of a link printed without a key, repeat for every share")
+}
+
+func webhookFlags(flags *FlagSet, options *Options) {
+	flags.StringListFlag(&options.Webhooks, "webhook", "", "<url>", "POST the result as JSON to this url, in addition to the webhooks of the profile, repeatable")
+	flags.BoolFlag(&options.WebhookOmitKey, "webhook-omit-key", "", "send the link to --webhook without its key")
+	flags.StringListFlag(&options.Labels, "label", "", "<name=value>", "add this label to the webhook payloads, repeatable")
+}
+
+func logFlags(flags *FlagSet, options *Options) {
+	flags.VerbosityFlag(&options.Verbosity, "log every API call to stderr, -vv also the headers and bodies (secrets are redacted)")
+	flags.StringFlag(&options.LogOutput, "log-file", "", "<file>", "append the log to this file instead of stderr")
+	flags.StringFlag(&options.LogFormat, "log-format", "", "<format>", "text (default) or json")
+}
 
-	if rem[0] == "encrypt" {
-		encrypt = true
-	} else if rem[0] == "decrypt" {
-		encrypt = false
-	} else {
-		fmt.Println("Unknown argument: ", rem[0])
-		printUsageAndExit(1)
+func outputFlag(flags *FlagSet, options *Options) {
+	flags.StringFlag(&options.Output, "output", "o", "<format>", "text (default), json or jsonl")
+}
+
+func main() {
+	defer exitOnFatal()
+	command, args, options := parseCommandLine(os.Args[1:])
+	if !isValidOutputFormat(options.Output) {
+		usageError(command, "Unknown output format: %s", options.Output)
+	}
+	setOutputFormat(options.Output)
+	if !isValidLogFormat(options.LogFormat) {
+		usageError(command, "Unknown log format: %s", options.LogFormat)
+	}
+	configError = resolveProfile(&options)
+	if configError != nil && command.Name != "doctor" {
+		fmt.Fprintln(os.Stderr, "Configuration error:", configError)
+		os.Exit(1)
 	}
+	if err := setupLogging(&options); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open the log file:", err)
+		os.Exit(1)
+	}
+
+	ctx := notifyInterrupt()
+	defer exitIfInterrupted(ctx)
+
+	command.Run(ctx, args, &options)
+}
 
-	if !encrypt {
-		if len(rem) != 2 {
-			fmt.Println("Too many arguments for decryption")
-			printUsageAndExit(1)
-		}
+// notifyInterrupt returns a context that the first SIGINT or SIGTERM cancels.
+// A second signal terminates immediately.
+func notifyInterrupt() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		interruptSignal = <-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+// exitIfInterrupted ends an interrupted command with a short message and the
+// exit code of the signal, whether the command panicked on the cancelled
+// context or returned. Other panics are passed on.
+func exitIfInterrupted(ctx context.Context) {
+	r := recover()
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "\nInterrupted")
+		os.Exit(interruptedExitCode(interruptSignal))
+	}
+	if r != nil {
+		panic(r)
 	}
-	return encrypt, rem[1:]
 }
 
-func main() {
-	rem, options := parseOptions()
-	if options.Help {
-		printUsageAndExit(0)
+// exitOnFatal reports the problem passed to fatal and exits with 1.
+func exitOnFatal() {
+	r := recover()
+	if err, ok := r.(fatalError); ok {
+		fmt.Fprintln(os.Stderr, err.message)
+		os.Exit(1)
 	}
-	encrypt, f := parseMode(rem, &options)
-
-	if encrypt {
-		url := encryptFiles(f, &options)
-		fmt.Println("Successfully encrypted and uploaded the file(s)")
-		fmt.Println("Download url:")
-		fmt.Println(url)
-	} else {
-		decryptFromUrl(f[0], &options)
+	if r != nil {
+		panic(r)
+	}
+}
+
+// interruptedExitCode follows the shell convention of 128+n for signal n.
+func interruptedExitCode(sig os.Signal) int {
+	if number, ok := sig.(syscall.Signal); ok {
+		return 128 + int(number)
 	}
+	return 128 + int(syscall.SIGINT)
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OutputText  = "text"
+	OutputJson  = "json"
+	OutputJsonl = "jsonl"
+)
+
+// Version of the JSON documents printed with --output json/jsonl. Only
+// incremented for incompatible changes, new fields can appear at any time.
+const outputSchemaVersion = 1
+
+var outputFormat = OutputText
+
+// Human readable messages. They move to stderr when stdout is reserved for
+// machine readable output.
+var humanOut io.Writer = os.Stdout
+
+func setOutputFormat(format string) {
+	outputFormat = format
+	if format != OutputText {
+		humanOut = os.Stderr
+	}
+}
+
+func isValidOutputFormat(format string) bool {
+	return format == OutputText || format == OutputJson || format == OutputJsonl
+}
+
+type EncryptResult struct {
+	Schema            int                 `json:"schema"`
+	Command           string              `json:"command"`
+	Label             string              `json:"label,omitempty"` // of the recipient with --recipients
+	Link              string              `json:"link"`
+	TransferId        string              `json:"transfer_id"`
+	ManagementToken   string              `json:"management_token"` // authorizes "sft revoke"
+	DeleteAfter       string              `json:"delete_after"`
+	ExpiresAt         string              `json:"expires_at,omitempty"`
+	DownloadLimit     int                 `json:"download_limit"`
+	Recipient         string              `json:"recipient,omitempty"`
+	Key               string              `json:"key,omitempty"` // only when not part of the link
+	KeyShares         []string            `json:"key_shares,omitempty"`
+	KeyThreshold      int                 `json:"key_threshold,omitempty"`
+	ChecksumAlgorithm string              `json:"checksum_algorithm"`
+	Files             []EncryptFileResult `json:"files"`
+}
+
+type EncryptFileResult struct {
+	Name        string `json:"name"`
+	Size        int    `json:"size"`
+	ContentType string `json:"content_type"`
+	Chunks      int    `json:"chunks"`
+	Checksum    string `json:"checksum"`
+}
+
+type DecryptResult struct {
+	Schema      int                 `json:"schema"`
+	Command     string              `json:"command"`
+	TransferId  string              `json:"transfer_id"`
+	Transfer    TransferResponse    `json:"transfer"`
+	Description string              `json:"description"`
+	Downloaded  bool                `json:"downloaded"`
+	Signer      *SignerResult       `json:"signer,omitempty"`
+	Files       []DecryptFileResult `json:"files"`
+}
+
+type DecryptFileResult struct {
+	Name               string `json:"name"`
+	Size               int    `json:"size"`
+	ContentType        string `json:"content_type"`
+	Chunks             int    `json:"chunks"`
+	DownloadCount      int    `json:"download_count"`
+	RemainingDownloads int    `json:"remaining_downloads"`
+	Path               string `json:"path,omitempty"`
+	// Checksums of the downloaded file and whether they match the expected ones
+	Checksums      map[string]string `json:"checksums,omitempty"`
+	ChecksumStatus string            `json:"checksum_status,omitempty"`
+	// Bytes written to Path, a different size than Size is a mismatch too
+	Written int64 `json:"-"`
+	// Result of the scan, a file that failed it is in the quarantine unless it
+	// couldn't be moved there
+	ScanStatus  string `json:"scan_status,omitempty"`
+	ScanDetail  string `json:"scan_detail,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+// emitEvent streams a single progress event, only with --output jsonl.
+func emitEvent(event string, fields map[string]interface{}) {
+	if outputFormat != OutputJsonl {
+		return
+	}
+	line := map[string]interface{}{
+		"schema": outputSchemaVersion,
+		"event":  event,
+		"time":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for key, value := range fields {
+		line[key] = value
+	}
+	writeJson(line, false)
+}
+
+// emitResult prints the final document of a command. With jsonl it is the
+// last event of the stream.
+func emitResult(result interface{}) {
+	switch outputFormat {
+	case OutputJson:
+		writeJson(result, true)
+	case OutputJsonl:
+		emitEvent("result", map[string]interface{}{"result": result})
+	}
+}
+
+func writeJson(value interface{}, indent bool) {
+	encoder := json.NewEncoder(os.Stdout)
+	if indent {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(value); err != nil {
+		panic(err)
+	}
+}
+
+// downloadLimit turns the "2l" style delete_after_count into a number.
+func downloadLimit(deleteAfterCount string) int {
+	count, err := strconv.Atoi(strings.TrimSuffix(deleteAfterCount, "l"))
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// expiryTime estimates when a transfer created at createdAt with a
+// delete_after like "7d" expires. It returns the zero time for unknown units.
+func expiryTime(createdAt time.Time, deleteAfter string) time.Time {
+	if len(deleteAfter) < 2 {
+		return time.Time{}
+	}
+	amount, err := strconv.Atoi(deleteAfter[:len(deleteAfter)-1])
+	if err != nil {
+		return time.Time{}
+	}
+	var unit time.Duration
+	switch deleteAfter[len(deleteAfter)-1] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.Time{}
+	}
+	return createdAt.Add(time.Duration(amount) * unit)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func printEncryptResult(result *EncryptResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Println("Successfully encrypted and uploaded the file(s)")
+	fmt.Println("Download url:")
+	fmt.Println(result.Link)
+	fmt.Println("")
+	if result.Key != "" || len(result.KeyShares) > 0 {
+		printSeparateKey(result)
+		fmt.Println("")
+	}
+	fmt.Println("Management token (revokes the link with 'sft revoke <token>'):")
+	fmt.Println(result.ManagementToken)
+	fmt.Println("")
+	printChecksums(result.ChecksumAlgorithm, result.Files)
+}
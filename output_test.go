@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryTime(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		deleteAfter string
+		want        time.Time
+	}{
+		{"30m", created.Add(30 * time.Minute)},
+		{"1h", created.Add(time.Hour)},
+		{"7d", time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC)},
+		{"2w", time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)},
+		{"", time.Time{}},
+		{"d", time.Time{}},
+		{"7", time.Time{}},
+		{"7y", time.Time{}},
+		{"xd", time.Time{}},
+	}
+	for _, test := range tests {
+		if got := expiryTime(created, test.deleteAfter); !got.Equal(test.want) {
+			t.Errorf("expiryTime(%q) = %s, want %s", test.deleteAfter, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+)
+
+type parallelResult[T any] struct {
+	value      T
+	panicValue interface{}
+}
+
+// orderedParallel calls produce for 0..n-1 with at most limit calls running
+// or waiting to be consumed, and hands the results to consume in order on the
+// calling goroutine. A panic in produce cancels the remaining work and is
+// re-raised here, so callers can keep using panics for errors.
+func orderedParallel[T any](ctx context.Context, limit int, n int, produce func(ctx context.Context, i int) T, consume func(i int, value T)) {
+	limit = max(limit, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan parallelResult[T], n)
+	for i := range results {
+		results[i] = make(chan parallelResult[T], 1)
+	}
+	slots := make(chan struct{}, limit)
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				result := parallelResult[T]{}
+				defer func() {
+					result.panicValue = recover()
+					results[i] <- result
+				}()
+				result.value = produce(ctx, i)
+			}(i)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		var result parallelResult[T]
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			panic(ctx.Err())
+		}
+		if result.panicValue != nil {
+			cancel()
+			panic(result.panicValue)
+		}
+		consume(i, result.value)
+		<-slots
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Only the beginning of bigger files is searched for secrets.
+const secretScanLimit = 64 << 20
+
+// ContentPolicy decides which files may be uploaded, it is the [content]
+// table of the policy file and [content_policy] of the config file.
+type ContentPolicy struct {
+	// The built-in detection of secrets, on unless false
+	Secrets *bool    `toml:"secrets"`
+	Deny    []string `toml:"deny"`
+	// Glob of the file name to the largest allowed size, e.g. "*.iso" = "4GB"
+	MaxSize map[string]string `toml:"max_size"`
+	// --ignore-policy doesn't override the rules, only in the policy file
+	Mandatory bool `toml:"mandatory"`
+}
+
+// TransferPolicy is the [transfer] table of the policy file. The defaults
+// replace those of sft, the limits and requirements can't be relaxed.
+type TransferPolicy struct {
+	BaseUrl             string `toml:"base_url"`
+	DeleteAfter         string `toml:"delete_after"`
+	DeleteAfterCount    int    `toml:"delete_after_count"`
+	MaxDeleteAfter      string `toml:"max_delete_after"`
+	MaxDeleteAfterCount int    `toml:"max_delete_after_count"`
+	// sft can't send a password to the server, it refuses every upload then
+	RequirePassword  bool     `toml:"require_password"`
+	RequireRecipient bool     `toml:"require_recipient"`
+	AllowedHosts     []string `toml:"allowed_hosts"` // globs, e.g. "*.example.com"
+}
+
+// OrgPolicy is the policy file of the organization, see orgPolicyPath.
+type OrgPolicy struct {
+	Content  ContentPolicy  `toml:"content"`
+	Transfer TransferPolicy `toml:"transfer"`
+}
+
+var orgPolicy OrgPolicy
+var orgPolicyLoaded bool
+
+type PolicyViolation struct {
+	Path      string `json:"path"`
+	Problem   string `json:"problem"`
+	Mandatory bool   `json:"mandatory"`
+}
+
+// Names of files that usually hold secrets.
+var secretFileNames = []string{
+	".env", ".env.*", "*.env",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519",
+	"*.keychain", "*.keychain-db", "*.kdbx", "*.p12", "*.pfx", "*.jks",
+	".netrc", ".pgpass", ".git-credentials", ".npmrc", ".pypirc",
+}
+
+var secretPatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"a PEM private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"an AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"a Google service account key", regexp.MustCompile(`"private_key_id"\s*:`)},
+	{"a Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"a GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"a Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"an Azure storage key", regexp.MustCompile(`AccountKey=[A-Za-z0-9+/]{40,}={0,2}`)},
+}
+
+// orgPolicyPath is where administrators put the policy of the organization.
+func orgPolicyPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "sft", "policy.toml")
+	}
+	return "/etc/sft/policy.toml"
+}
+
+// loadOrgPolicy reads the policy file of the organization, if there is one.
+func loadOrgPolicy() error {
+	path := orgPolicyPath()
+	_, err := toml.DecodeFile(path, &orgPolicy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := checkContentPolicy(&orgPolicy.Content); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkTransferPolicy(&orgPolicy.Transfer); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	orgPolicyLoaded = true
+	return nil
+}
+
+func checkContentPolicy(policy *ContentPolicy) error {
+	for _, glob := range policy.Deny {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid deny pattern %s", glob)
+		}
+	}
+	for glob, size := range policy.MaxSize {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid max_size pattern %s", glob)
+		}
+		if _, err := parseSize(size); err != nil {
+			return fmt.Errorf("max_size %s: %w", glob, err)
+		}
+	}
+	return nil
+}
+
+// parseSize reads sizes like "500", "20MB" or "4GB", with 1KB = 1000 bytes
+// like the sizes sft prints.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(value, unit) {
+			multiplier = int64(math.Pow(1000, float64(i+1)))
+			value = strings.TrimSuffix(value, unit)
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
+
+func isSecretsEnabled(policy *ContentPolicy) bool {
+	return policy.Secrets == nil || *policy.Secrets
+}
+
+// matchesFile tells whether a glob matches the name of the file, or its path
+// for globs with a slash.
+func matchesFile(glob string, path string) bool {
+	if strings.Contains(glob, "/") {
+		matched, _ := filepath.Match(glob, filepath.ToSlash(path))
+		return matched
+	}
+	matched, _ := filepath.Match(glob, filepath.Base(path))
+	return matched
+}
+
+// ContentRules are the content policies of the config file and of the
+// organization together.
+type ContentRules struct {
+	policies         []*ContentPolicy
+	secrets          bool
+	secretsMandatory bool
+}
+
+func activeContentRules() ContentRules {
+	userPolicy := config.ContentPolicy
+	rules := ContentRules{policies: []*ContentPolicy{&userPolicy}}
+	if orgPolicyLoaded {
+		rules.policies = append(rules.policies, &orgPolicy.Content)
+	}
+	rules.secrets = isSecretsEnabled(&userPolicy) || (orgPolicyLoaded && isSecretsEnabled(&orgPolicy.Content))
+	rules.secretsMandatory = orgPolicyLoaded && isSecretsEnabled(&orgPolicy.Content) && orgPolicy.Content.Mandatory
+	return rules
+}
+
+// checkFile applies the rules to the name and size of a file, the contents
+// are searched by findSecret.
+func (r *ContentRules) checkFile(path string, size int64) []PolicyViolation {
+	violations := make([]PolicyViolation, 0)
+	report := func(mandatory bool, format string, a ...interface{}) {
+		violations = append(violations, PolicyViolation{path, fmt.Sprintf(format, a...), mandatory})
+	}
+	if r.secrets {
+		for _, glob := range secretFileNames {
+			if matchesFile(glob, path) {
+				report(r.secretsMandatory, "usually holds secrets (%s)", glob)
+				break
+			}
+		}
+	}
+	for _, policy := range r.policies {
+		for _, glob := range policy.Deny {
+			if matchesFile(glob, path) {
+				report(policy.Mandatory, "is denied (%s)", glob)
+			}
+		}
+		globs := make([]string, 0)
+		for glob := range policy.MaxSize {
+			globs = append(globs, glob)
+		}
+		sort.Strings(globs)
+		for _, glob := range globs {
+			limit, _ := parseSize(policy.MaxSize[glob])
+			if matchesFile(glob, path) && size > limit {
+				report(policy.Mandatory, "is %s, %s files may be %s", formatBytes(size), glob, formatBytes(limit))
+			}
+		}
+	}
+	return violations
+}
+
+// secretViolation is the violation of a file that contains a secret.
+func (r *ContentRules) secretViolation(path string, secret string) PolicyViolation {
+	return PolicyViolation{path, "contains " + secret, r.secretsMandatory}
+}
+
+// checkFiles applies the content policy of the organization and the one of
+// the config file to the files before anything is uploaded.
+func checkFiles(paths []string) ([]PolicyViolation, error) {
+	rules := activeContentRules()
+	violations := make([]PolicyViolation, 0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !rules.secrets {
+			violations = append(violations, rules.checkFile(path, info.Size())...)
+			continue
+		}
+		if absolute, err := filepath.Abs(path); err == nil && slices.Contains(strings.Split(filepath.ToSlash(absolute), "/"), ".git") {
+			violations = append(violations, PolicyViolation{path, "is part of a .git directory", rules.secretsMandatory})
+		}
+		violations = append(violations, rules.checkFile(path, info.Size())...)
+		if info.Mode().IsRegular() {
+			found, err := findSecret(path)
+			if err != nil {
+				return nil, err
+			}
+			if found != "" {
+				violations = append(violations, rules.secretViolation(path, found))
+			}
+		}
+	}
+	return violations, nil
+}
+
+// findSecret searches the file for the secret patterns and returns the name
+// of the first one found.
+func findSecret(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, secretScanLimit))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+	return matchSecret(data), nil
+}
+
+// matchSecret returns the name of the first secret pattern found in data.
+func matchSecret(data []byte) string {
+	for _, secret := range secretPatterns {
+		if secret.pattern.Match(data) {
+			return secret.name
+		}
+	}
+	return ""
+}
+
+// policyViolations returns the violations that block the upload, and those
+// that --ignore-policy overrides.
+func policyViolations(paths []string, options *Options) ([]PolicyViolation, []PolicyViolation, error) {
+	violations, err := checkFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocking, ignored := splitViolations(violations, options)
+	return blocking, ignored, nil
+}
+
+func splitViolations(violations []PolicyViolation, options *Options) ([]PolicyViolation, []PolicyViolation) {
+	blocking := make([]PolicyViolation, 0)
+	ignored := make([]PolicyViolation, 0)
+	for _, violation := range violations {
+		if options.IgnorePolicy && !violation.Mandatory {
+			ignored = append(ignored, violation)
+		} else {
+			blocking = append(blocking, violation)
+		}
+	}
+	return blocking, ignored
+}
+
+// enforcePolicy stops the command with a report when the files violate the
+// content policy.
+func enforcePolicy(paths []string, options *Options) {
+	violations, err := checkFiles(paths)
+	if err != nil {
+		fatal("Could not check the files: %v", err)
+	}
+	enforceViolations(violations, options)
+}
+
+// enforceViolations reports the violations and stops the command unless
+// --ignore-policy overrides all of them.
+func enforceViolations(violations []PolicyViolation, options *Options) {
+	blocking, ignored := splitViolations(violations, options)
+	if len(blocking) == 0 {
+		if len(ignored) > 0 {
+			fmt.Fprintln(os.Stderr, "Uploading despite the content policy (--ignore-policy):")
+			printViolations(ignored)
+			emitEvent("policy_ignored", map[string]interface{}{"violations": ignored})
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "The content policy doesn't allow uploading:")
+	printViolations(blocking)
+	mandatory := false
+	for _, violation := range blocking {
+		mandatory = mandatory || violation.Mandatory
+	}
+	if mandatory {
+		fatal("Rules marked mandatory are set by %s and can't be overridden", orgPolicyPath())
+	}
+	fatal("Nothing was uploaded, --ignore-policy uploads the files anyway")
+}
+
+func printViolations(violations []PolicyViolation) {
+	for _, violation := range violations {
+		if violation.Mandatory {
+			fmt.Fprintf(os.Stderr, "  %s %s (mandatory)\n", violation.Path, violation.Problem)
+		} else {
+			fmt.Fprintf(os.Stderr, "  %s %s\n", violation.Path, violation.Problem)
+		}
+	}
+}
+
+func checkTransferPolicy(policy *TransferPolicy) error {
+	if policy.BaseUrl != "" {
+		if _, err := url.ParseRequestURI(policy.BaseUrl); err != nil {
+			return fmt.Errorf("invalid base_url: %w", err)
+		}
+	}
+	for _, period := range []string{policy.DeleteAfter, policy.MaxDeleteAfter} {
+		if _, ok := deleteAfterDuration(period); period != "" && !ok {
+			return fmt.Errorf("invalid period %s", period)
+		}
+	}
+	for _, host := range policy.AllowedHosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("invalid allowed_hosts pattern %s", host)
+		}
+	}
+	return nil
+}
+
+// deleteAfterDuration turns a delete_after like "7d" into a duration.
+func deleteAfterDuration(deleteAfter string) (time.Duration, bool) {
+	start := time.Unix(0, 0)
+	expiry := expiryTime(start, deleteAfter)
+	if expiry.IsZero() {
+		return 0, false
+	}
+	return expiry.Sub(start), true
+}
+
+// applyTransferDefaults puts the defaults of the policy file in place of
+// those of sft, within its limits.
+func applyTransferDefaults(profile Profile) Profile {
+	policy := &orgPolicy.Transfer
+	profile = mergeProfile(profile, Profile{
+		BaseUrl:          policy.BaseUrl,
+		DeleteAfter:      policy.DeleteAfter,
+		DeleteAfterCount: policy.DeleteAfterCount,
+	})
+	if policy.MaxDeleteAfter != "" && !isWithinDeleteAfter(profile.DeleteAfter, policy.MaxDeleteAfter) {
+		profile.DeleteAfter = policy.MaxDeleteAfter
+	}
+	if policy.MaxDeleteAfterCount > 0 && profile.DeleteAfterCount > policy.MaxDeleteAfterCount {
+		profile.DeleteAfterCount = policy.MaxDeleteAfterCount
+	}
+	return profile
+}
+
+func isWithinDeleteAfter(deleteAfter string, maxDeleteAfter string) bool {
+	duration, ok := deleteAfterDuration(deleteAfter)
+	limit, _ := deleteAfterDuration(maxDeleteAfter)
+	return ok && duration <= limit
+}
+
+// refusedByPolicy stops a command the policy of the organization doesn't allow.
+func refusedByPolicy(format string, a ...interface{}) {
+	fatal("%s, the policy of your organization (%s) doesn't allow it", fmt.Sprintf(format, a...), orgPolicyPath())
+}
+
+// checkTransferLimits refuses an expiry or a download limit over the limits
+// of the policy file.
+func checkTransferLimits(deleteAfter string, deleteAfterCount int) {
+	policy := &orgPolicy.Transfer
+	if policy.MaxDeleteAfter != "" && !isWithinDeleteAfter(deleteAfter, policy.MaxDeleteAfter) {
+		refusedByPolicy("Deleting the transfer after %s is longer than %s", deleteAfter, policy.MaxDeleteAfter)
+	}
+	if policy.MaxDeleteAfterCount > 0 && deleteAfterCount > policy.MaxDeleteAfterCount {
+		refusedByPolicy("%d downloads are more than %d", deleteAfterCount, policy.MaxDeleteAfterCount)
+	}
+}
+
+// checkAllowedServer refuses a server the policy file doesn't list.
+func checkAllowedServer(baseUrl string) {
+	hosts := orgPolicy.Transfer.AllowedHosts
+	if len(hosts) == 0 {
+		return
+	}
+	parsed, err := url.Parse(baseUrl)
+	if err != nil {
+		fatal("Invalid server %s", baseUrl)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, pattern := range hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return
+		}
+	}
+	refusedByPolicy("The server %s is not one of %s", host, strings.Join(hosts, ", "))
+}
+
+// enforceTransferPolicy checks a new transfer against the policy file,
+// before anything is uploaded.
+func enforceTransferPolicy(options *Options) {
+	policy := &orgPolicy.Transfer
+	checkAllowedServer(activeProfile.BaseUrl)
+	checkTransferLimits(activeProfile.DeleteAfter, activeProfile.DeleteAfterCount)
+	if policy.RequirePassword && !options.Password {
+		refusedByPolicy("Uploading without a password (-p)")
+	}
+	if policy.RequirePassword {
+		fatal("The policy of your organization (%s) requires a password, which sft can't set on the server", orgPolicyPath())
+	}
+	if policy.RequireRecipient && options.Recipient == "" {
+		refusedByPolicy("A link without --recipient")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+	"golang.org/x/term"
+)
+
+// The progress display currently on screen, other output has to go through it.
+var activeProgress *TransferProgress
+
+type TransferProgress struct {
+	doing   string
+	done    string
+	writer  progress.Writer // nil when stderr is not a terminal
+	overall *progress.Tracker
+	start   time.Time
+	files   int
+	bytes   atomic.Int64
+}
+
+type FileProgress struct {
+	parent  *TransferProgress
+	name    string
+	tracker *progress.Tracker
+	mutex   sync.Mutex
+}
+
+type ChunkProgress struct {
+	file *FileProgress
+	// bytes counted by the current attempt, rolled back when the chunk is retried
+	counted int64
+	limit   int64
+}
+
+// doing and done are the forms of the verb for the messages, like
+// "Uploading" and "Uploaded".
+func newTransferProgress(doing string, done string, totalSize int64) *TransferProgress {
+	p := &TransferProgress{
+		doing: doing,
+		done:  done,
+		start: time.Now(),
+	}
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		return p
+	}
+
+	p.writer = progress.NewWriter()
+	p.writer.SetOutputWriter(os.Stderr)
+	p.writer.SetAutoStop(false)
+	p.writer.SetMessageWidth(32)
+	p.writer.SetTrackerLength(30)
+	p.writer.SetUpdateFrequency(200 * time.Millisecond)
+	p.writer.Style().Visibility.ETA = true
+	p.writer.Style().Visibility.Speed = true
+	p.writer.Style().Visibility.Value = true
+	p.writer.Style().Options.TimeInProgressPrecision = time.Second
+	p.writer.Style().Options.TimeDonePrecision = time.Second
+
+	p.overall = &progress.Tracker{
+		Message: "Total",
+		Total:   max(totalSize, 1),
+		Units:   progress.UnitsBytes,
+	}
+	p.writer.AppendTracker(p.overall)
+	go p.writer.Render()
+	activeProgress = p
+	return p
+}
+
+func (p *TransferProgress) enabled() bool {
+	return p.writer != nil
+}
+
+func (p *TransferProgress) startFile(name string, size int64) *FileProgress {
+	p.files++
+	f := &FileProgress{parent: p, name: name}
+	emitEvent("file_started", map[string]interface{}{"name": name, "size": size})
+	if !p.enabled() {
+		fmt.Fprintln(humanOut, p.doing, name)
+		return f
+	}
+	f.tracker = &progress.Tracker{
+		Message: name,
+		Total:   max(size, 1),
+		Units:   progress.UnitsBytes,
+	}
+	p.writer.AppendTracker(f.tracker)
+	return f
+}
+
+// finish stops the bars and prints a one line summary of the whole transfer.
+func (p *TransferProgress) finish() {
+	if p.enabled() {
+		p.overall.MarkAsDone()
+		p.writer.Stop()
+		for p.writer.IsRenderInProgress() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		activeProgress = nil
+	}
+	elapsed := time.Since(p.start)
+	speed := int64(float64(p.bytes.Load()) / max(elapsed.Seconds(), 0.001))
+	fmt.Fprintf(humanOut, "%s %d file(s), %s in %s (%s/s)\n\n",
+		p.done, p.files, progress.UnitsBytes.Sprint(p.bytes.Load()),
+		elapsed.Round(time.Second), progress.UnitsBytes.Sprint(speed))
+}
+
+// startChunk begins tracking a chunk, at most limit bytes are counted for it
+// until done books its exact size.
+func (f *FileProgress) startChunk(limit int64) *ChunkProgress {
+	return &ChunkProgress{file: f, limit: limit}
+}
+
+func (f *FileProgress) finish() {
+	emitEvent("file_done", map[string]interface{}{"name": f.name})
+	if !f.parent.enabled() {
+		fmt.Fprintln(humanOut, " done")
+		return
+	}
+	f.tracker.MarkAsDone()
+}
+
+func (f *FileProgress) add(n int64) {
+	if n == 0 || f.tracker == nil {
+		return
+	}
+	f.tracker.Increment(n)
+	f.parent.overall.Increment(n)
+}
+
+// reader counts the bytes read from r towards the progress of the file. Every
+// call starts a new attempt for the chunk, taking back whatever an earlier,
+// failed attempt has counted.
+func (c *ChunkProgress) reader(r io.Reader) io.Reader {
+	c.file.mutex.Lock()
+	c.file.add(-c.counted)
+	c.counted = 0
+	c.file.mutex.Unlock()
+	return &countingReader{r, c}
+}
+
+func (c *ChunkProgress) count(n int64) {
+	c.file.mutex.Lock()
+	defer c.file.mutex.Unlock()
+	// Stay below the limit, a tracker that reaches its total can't be rolled back
+	n = min(n, c.limit-1-c.counted)
+	if n <= 0 {
+		return
+	}
+	c.counted += n
+	c.file.add(n)
+}
+
+func (c *ChunkProgress) done(size int64) {
+	c.file.mutex.Lock()
+	c.file.add(size - c.counted)
+	c.counted = size
+	c.file.mutex.Unlock()
+	c.file.parent.bytes.Add(size)
+	emitEvent("chunk_done", map[string]interface{}{"name": c.file.name, "bytes": size})
+	if !c.file.parent.enabled() {
+		fmt.Fprint(humanOut, ".")
+	}
+}
+
+type countingReader struct {
+	reader   io.Reader
+	progress *ChunkProgress
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.progress.count(int64(n))
+	return n, err
+}
+
+// printStatus writes a message to stderr without tearing up the progress bars.
+func printStatus(format string, a ...interface{}) {
+	if activeProgress != nil {
+		activeProgress.writer.Log(format, a...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jedib0t/go-pretty/v6/progress"
+)
+
+// AES-GCM appends a 16 byte authentication tag to every chunk and to the metadata.
+const gcmTagSize = 16
+
+// Server side chunk ids are UUIDs, secrets are base64 encoded SHA-256 hashes.
+var placeholderChunk = UploadedData{
+	Uuid:   strings.Repeat("0", 36),
+	Secret: strings.Repeat("A", 44),
+}
+
+// Bytes the signature adds to the metadata, the same for every metadata of a
+// signing key. Measured once, estimates are computed many times by --split.
+var signatureSize = int64(-1)
+
+type UploadSize struct {
+	Plaintext int64
+	Overhead  int64
+	Metadata  int64
+}
+
+func (s UploadSize) total() int64 {
+	return s.Plaintext + s.Overhead + s.Metadata
+}
+
+func numChunks(size int64) int {
+	return int((size + maxChunkSize - 1) / maxChunkSize)
+}
+
+// computeUploadSize returns the number of bytes the server receives for the
+// pieces: the ciphertext of every chunk and the encrypted metadata.
+func computeUploadSize(pieces []UploadPiece) UploadSize {
+	size := UploadSize{}
+	uploadedFiles := make([]UploadedFile, 0)
+	for _, piece := range pieces {
+		chunks := make([]UploadedData, numChunks(piece.Size))
+		for i := range chunks {
+			chunks[i] = placeholderChunk
+		}
+		size.Plaintext += piece.Size
+		size.Overhead += int64(len(chunks)) * gcmTagSize
+		var checksums map[string]string
+		if piece.Checksum != nil && piece.Checksum.Embed {
+			checksums = map[string]string{
+				piece.Checksum.Algorithm: strings.Repeat("0", newChecksumHash(piece.Checksum.Algorithm).Size()*2),
+			}
+		}
+		uploadedFiles = append(uploadedFiles, UploadedFile{
+			piece.Name,
+			int(piece.Size),
+			chunks,
+			piece.ContentType,
+			checksums,
+		})
+	}
+	metadata, err := json.Marshal(Metadata{"", uploadedFiles, nil})
+	if err != nil {
+		panic(err)
+	}
+	size.Metadata = int64(len(metadata)) + metadataSignatureSize() + gcmTagSize
+	return size
+}
+
+func metadataSignatureSize() int64 {
+	if signingKey == nil {
+		return 0
+	}
+	if signatureSize < 0 {
+		empty := make([]UploadedFile, 0)
+		unsigned, err := json.Marshal(Metadata{"", empty, nil})
+		if err != nil {
+			panic(err)
+		}
+		signed, err := json.Marshal(newMetadata("", empty))
+		if err != nil {
+			panic(err)
+		}
+		signatureSize = int64(len(signed) - len(unsigned))
+	}
+	return signatureSize
+}
+
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%d bytes (%s)", n, progress.UnitsBytes.Sprint(n))
+}
+
+// UploadQuota follows the remaining upload size the server reports after
+// every chunk, so an upload that can't fit stops before the server refuses it.
+type UploadQuota struct {
+	mutex sync.Mutex
+	// bytes not yet confirmed by the server, including the metadata
+	pending  int64
+	inFlight int64
+}
+
+func newUploadQuota(size UploadSize) *UploadQuota {
+	return &UploadQuota{pending: size.total()}
+}
+
+func (q *UploadQuota) start(n int64) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	q.inFlight += n
+	q.mutex.Unlock()
+}
+
+// done books an uploaded chunk of n bytes. Chunks still in flight might
+// already be included in available, so they are not counted as missing.
+func (q *UploadQuota) done(n int64, available int64) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.inFlight -= n
+	q.pending -= n
+	missing := q.pending - q.inFlight
+	if available < missing {
+		panic(fmt.Sprintf("The server has only %s left for this transfer, %s are still to be uploaded: %s short. Aborting.",
+			formatBytes(available), formatBytes(missing), formatBytes(missing-available)))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Prefixes of the printable keys and of a link fragment wrapped for a recipient.
+const (
+	publicKeyPrefix  = "sft-pub-"
+	secretKeyPrefix  = "sft-secret-"
+	wrappedKeyPrefix = "x25519-"
+)
+
+type KeygenResult struct {
+	Schema    int    `json:"schema"`
+	Command   string `json:"command"`
+	PublicKey string `json:"public_key"`
+	Identity  string `json:"identity"`
+}
+
+// defaultIdentityPath returns $XDG_CONFIG_HOME/sft/identity.
+func defaultIdentityPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sft", "identity")
+}
+
+func identityPath() string {
+	if activeProfile.Identity != "" {
+		return activeProfile.Identity
+	}
+	return defaultIdentityPath()
+}
+
+// generateIdentity writes a new X25519 private key to path, never replacing
+// an existing one.
+func generateIdentity(path string) KeygenResult {
+	if path == "" {
+		path = defaultIdentityPath()
+	}
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	publicKey := encodePublicKey(privateKey.PublicKey())
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		panic(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		fatal("%s already exists, remove it first or choose another file", path)
+	}
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(file, "# created: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(file, "# public key: %s\n", publicKey)
+	fmt.Fprintln(file, secretKeyPrefix+base64.RawURLEncoding.EncodeToString(privateKey.Bytes()))
+	err = file.Close()
+	if err != nil {
+		panic(err)
+	}
+	return KeygenResult{
+		Schema:    outputSchemaVersion,
+		Command:   "keygen",
+		PublicKey: publicKey,
+		Identity:  path,
+	}
+}
+
+func printKeygenResult(result *KeygenResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Println("Identity saved to", result.Identity)
+	fmt.Println("Public key (send it to the people who share files with you):")
+	fmt.Println(result.PublicKey)
+}
+
+func encodePublicKey(publicKey *ecdh.PublicKey) string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(publicKey.Bytes())
+}
+
+func parsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	if !strings.HasPrefix(encoded, publicKeyPrefix) {
+		return nil, fmt.Errorf("a public key starts with %s", publicKeyPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encoded, publicKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// loadIdentity reads the private key from an identity file, skipping the
+// comment lines.
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, secretKeyPrefix) {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, secretKeyPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: no %s key found", path, secretKeyPrefix)
+}
+
+// wrapCipher derives the AES-GCM cipher of a wrapped key from the shared
+// secret and both public keys.
+func wrapCipher(sharedSecret []byte, ephemeral []byte, recipient []byte) cipher.AEAD {
+	salt := append(bytes.Clone(ephemeral), recipient...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt, []byte("sft recipient key")), key)
+	if err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aesgcm
+}
+
+// wrapFragment encrypts the key fragment of a link for the recipient with a
+// fresh ephemeral key. The key is only used once, so the nonce can be fixed.
+func wrapFragment(fragment string, recipient *ecdh.PublicKey) string {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		panic(err)
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	aesgcm := wrapCipher(sharedSecret, ephemeralPublic, recipient.Bytes())
+	sealed := aesgcm.Seal(nil, make([]byte, aesgcm.NonceSize()), []byte(fragment), nil)
+	return wrappedKeyPrefix + base64.RawURLEncoding.EncodeToString(append(ephemeralPublic, sealed...))
+}
+
+func isWrappedFragment(fragment string) bool {
+	return strings.HasPrefix(fragment, wrappedKeyPrefix)
+}
+
+// unwrapFragment turns a wrapped fragment back into the key fragment with
+// the identity of the active profile.
+func unwrapFragment(fragment string) string {
+	path := identityPath()
+	identity, err := loadIdentity(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fatal("The link is encrypted for a recipient, but there is no identity at %s. Use --identity <file>.", path)
+	}
+	if err != nil {
+		fatal("Could not read the identity: %v", err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(fragment, wrappedKeyPrefix))
+	if err != nil || len(data) < 32 {
+		fatal("Please double check the url, the wrapped key is damaged")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		fatal("Please double check the url, the wrapped key is damaged")
+	}
+	sharedSecret, err := identity.ECDH(ephemeral)
+	if err != nil {
+		panic(err)
+	}
+	aesgcm := wrapCipher(sharedSecret, data[:32], identity.PublicKey().Bytes())
+	plaintext, err := aesgcm.Open(nil, make([]byte, aesgcm.NonceSize()), data[32:], nil)
+	if err != nil {
+		fatal("The link is not encrypted for the identity %s", path)
+	}
+	return string(plaintext)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type reshareChunk struct {
+	data      UploadedData
+	plaintext []byte
+}
+
+// reshareTransfer downloads the files of a link chunk by chunk and uploads
+// every chunk with a fresh key into a new transfer on the same server. The
+// plaintext only ever exists in memory, one chunk per parallel transfer.
+func reshareTransfer(ctx context.Context, link string, options *Options) EncryptResult {
+	recipientKey(options)
+	checkSeparateKey(options)
+	checkWebhookOptions(options)
+	if !isValidChecksumAlgorithm(options.ChecksumAlgorithm) {
+		fatal("Unknown checksum algorithm: %s", options.ChecksumAlgorithm)
+	}
+	loadActiveSigningKey()
+	baseUrl, token, key := parseUrl(link)
+	// The new transfer goes to the server of the link
+	activeProfile.BaseUrl = baseUrl
+	enforceTransferPolicy(options)
+	transferInfo := initiateDownloadRequest(ctx, token)
+	metadata := downloadMetadata(ctx, &transferInfo, key)
+	verifySignature(&metadata)
+	fileInfo := validateFiles(ctx, metadata.Files, transferInfo.DownloadToken)
+	if options.Description == "" {
+		options.Description = metadata.Description
+	}
+	// The contents are only known on the way, they are checked file by file
+	rules := activeContentRules()
+	violations := make([]PolicyViolation, 0)
+	for _, info := range fileInfo {
+		violations = append(violations, rules.checkFile(info.Name, int64(info.Size))...)
+	}
+	enforceViolations(violations, options)
+
+	// The chunks keep their sizes, so the upload is as big as the original
+	uploadSize := UploadSize{}
+	placeholderFiles := make([]UploadedFile, 0)
+	for _, info := range fileInfo {
+		uploadSize.Plaintext += int64(info.Size)
+		uploadSize.Overhead += int64(len(info.Chunks)) * gcmTagSize
+		if len(info.Checksums) > 0 || signingKey != nil {
+			options.EmbedChecksums = true
+		}
+		chunks := make([]UploadedData, len(info.Chunks))
+		for i := range chunks {
+			chunks[i] = placeholderChunk
+		}
+		checksums := map[string]string{}
+		for _, algorithm := range reshareChecksumAlgorithms(info.Checksums, options) {
+			checksums[algorithm] = strings.Repeat("0", newChecksumHash(algorithm).Size()*2)
+		}
+		placeholderFiles = append(placeholderFiles, UploadedFile{info.Name, info.Size, chunks, info.FileType, checksums})
+	}
+	placeholderMetadata, err := json.Marshal(newMetadata(options.Description, metadataFiles(placeholderFiles, options.EmbedChecksums)))
+	if err != nil {
+		panic(err)
+	}
+	uploadSize.Metadata = int64(len(placeholderMetadata)) + gcmTagSize
+	maxSize, fetched := getMaxUploadSize(ctx)
+	checkUploadSize(uploadSize, maxSize, fetched)
+	readPasswordIfNeeded(options)
+
+	transfer := createUploadRequest(ctx, &activeProfile)
+	createdAt := time.Now()
+	emitEvent("transfer_created", map[string]interface{}{"transfer_id": transfer.Uuid})
+	defer deleteTransferOnCancel(ctx, &transfer, options)
+	quota := newUploadQuota(uploadSize)
+	transferProgress := newTransferProgress("Resharing", "Reshared", uploadSize.Plaintext)
+	uploadedFiles := make([]UploadedFile, 0)
+	for _, info := range fileInfo {
+		fileProgress := transferProgress.startFile(info.Name, int64(info.Size))
+		chunks := make([]UploadedData, 0)
+		checksummer := newChecksummer(reshareChecksumAlgorithms(info.Checksums, options)...)
+		// The beginning of the file, as much as findSecret reads of a local one
+		scanned := make([]byte, 0)
+		reshare := func(ctx context.Context, i int) reshareChunk {
+			// Only an estimate for the progress, the sender decides the chunk size
+			chunkSize := min(int64(info.Size)-int64(i)*maxChunkSize, maxChunkSize)
+			chunkProgress := fileProgress.startChunk(max(chunkSize, 1))
+			plaintext := downloadChunk(ctx, &info.Chunks[i], transferInfo.DownloadToken, chunkProgress)
+			// The upload starts the progress of the chunk over
+			uploadedData := uploadData(ctx, plaintext, &transfer, quota, chunkProgress)
+			chunkProgress.done(int64(len(plaintext)))
+			return reshareChunk{uploadedData, plaintext}
+		}
+		orderedParallel(ctx, activeProfile.Parallelism, len(info.Chunks), reshare, func(i int, chunk reshareChunk) {
+			checksummer.Write(chunk.plaintext)
+			if rules.secrets && len(scanned) < secretScanLimit {
+				scanned = append(scanned, chunk.plaintext[:min(len(chunk.plaintext), secretScanLimit-len(scanned))]...)
+			}
+			chunks = append(chunks, chunk.data)
+		})
+		checksums := checksummer.sums()
+		for algorithm, checksum := range info.Checksums {
+			if got, ok := checksums[algorithm]; ok && got != checksum {
+				discardTransfer(ctx, &transfer)
+				fatal("%s doesn't match the checksum of the sender, the transfer was not reshared", info.Name)
+			}
+		}
+		if secret := matchSecret(scanned); secret != "" {
+			violations := []PolicyViolation{rules.secretViolation(info.Name, secret)}
+			if blocking, _ := splitViolations(violations, options); len(blocking) > 0 {
+				discardTransfer(ctx, &transfer)
+			}
+			enforceViolations(violations, options)
+		}
+		uploadedFiles = append(uploadedFiles, UploadedFile{info.Name, info.Size, chunks, info.FileType, checksums})
+		fileProgress.finish()
+	}
+	transferProgress.finish()
+	finalizeDownload(ctx, fileInfo, transferInfo.DownloadToken)
+	return completeTransfer(ctx, "reshare", &transfer, createdAt, uploadedFiles, "", options)
+}
+
+// reshareChecksumAlgorithms returns the algorithm of the options and those of
+// the checksums of the sender, which are verified on the way.
+func reshareChecksumAlgorithms(checksums map[string]string, options *Options) []string {
+	algorithms := []string{options.ChecksumAlgorithm}
+	for algorithm := range checksums {
+		if isValidChecksumAlgorithm(algorithm) && algorithm != options.ChecksumAlgorithm {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Chunks are big and expensive to lose, so they get the most patience.
+var chunkRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   time.Second,
+	MaxDelay:    time.Minute,
+}
+
+var requestRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    15 * time.Second,
+}
+
+// For requests that must not be repeated, or where a failure is an answer.
+var singleAttemptPolicy = RetryPolicy{
+	MaxAttempts: 1,
+}
+
+// Upper bound for waiting on a server provided Retry-After header.
+const maxRetryAfter = 5 * time.Minute
+
+type HttpStatusError struct {
+	Operation  string
+	StatusCode int
+	Status     string
+	Body       string
+	retryAfter time.Duration
+}
+
+func (e *HttpStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s failed: %s", e.Operation, e.Status)
+	}
+	return fmt.Sprintf("%s failed: %s: %s", e.Operation, e.Status, e.Body)
+}
+
+// doWithRetry sends the request created by newRequest and returns the body of
+// the first successful (2xx) response. Network errors and transient server
+// errors are retried with exponential backoff and jitter until the attempts of
+// the policy are used up or ctx is cancelled. newRequest is called for every
+// attempt, so it has to return a request with a fresh body each time.
+func doWithRetry(ctx context.Context, operation string, policy RetryPolicy, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	return doWithRetryReading(ctx, operation, policy, newRequest, nil)
+}
+
+// doWithRetryReading is doWithRetry, but every response body is read through
+// wrapBody, e.g. to report download progress.
+func doWithRetryReading(ctx context.Context, operation string, policy RetryPolicy, newRequest func(ctx context.Context) (*http.Request, error), wrapBody func(io.Reader) io.Reader) ([]byte, error) {
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		request, err := newRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var retryAfter time.Duration
+		responseBody, err := doOnce(operation, request, wrapBody)
+		if err == nil {
+			return responseBody, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if statusErr, ok := err.(*HttpStatusError); ok {
+			if !isRetryableStatus(statusErr.StatusCode) {
+				return nil, err
+			}
+			retryAfter = statusErr.retryAfter
+		}
+		lastErr = err
+
+		if attempt >= policy.MaxAttempts {
+			break
+		}
+		delay := backoffDelay(policy, attempt)
+		if retryAfter > 0 {
+			delay = min(retryAfter, maxRetryAfter)
+		}
+		printStatus("%s\nRetrying %s in %s (attempt %d of %d)",
+			redactError(err), operation, delay.Round(time.Millisecond), attempt+1, policy.MaxAttempts)
+		logger.Info("retry",
+			"operation", operation,
+			"attempt", attempt+1,
+			"delay_ms", delay.Milliseconds(),
+			"error", redactError(err))
+		emitEvent("retry", map[string]interface{}{
+			"operation": operation,
+			"attempt":   attempt + 1,
+			"delay_ms":  delay.Milliseconds(),
+			"error":     redactError(err),
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if policy.MaxAttempts == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", policy.MaxAttempts, lastErr)
+}
+
+func doOnce(operation string, request *http.Request, wrapBody func(io.Reader) io.Reader) ([]byte, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
+	var body io.Reader = response.Body
+	if statusOK && wrapBody != nil {
+		body = wrapBody(body)
+	}
+	responseBody, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if !statusOK {
+		return nil, newHttpStatusError(operation, response, responseBody)
+	}
+	return responseBody, nil
+}
+
+func newHttpStatusError(operation string, response *http.Response, body []byte) *HttpStatusError {
+	return &HttpStatusError{
+		Operation:  operation,
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Body:       strings.TrimSpace(string(body)),
+		retryAfter: parseRetryAfter(response),
+	}
+}
+
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter only honours Retry-After on 429 and 503, the two statuses
+// where the server uses it to tell us when to come back.
+func parseRetryAfter(response *http.Response) time.Duration {
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// backoffDelay doubles the base delay for every attempt, caps it at the
+// maximum and picks a random point in the upper half of that window.
+func backoffDelay(policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
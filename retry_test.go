@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 6, BaseDelay: time.Second, MaxDelay: time.Minute}
+	tests := []struct {
+		attempt int
+		// the delay is random in [window/2, window]
+		window time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{20, time.Minute},
+		// the shift overflows
+		{70, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(policy, test.attempt)
+			if delay < test.window/2 || delay > test.window {
+				t.Fatalf("backoffDelay(attempt %d) = %s, want between %s and %s", test.attempt, delay, test.window/2, test.window)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusTooManyRequests, "0", 0},
+		{http.StatusTooManyRequests, "30", 30 * time.Second},
+		{http.StatusServiceUnavailable, "120", 2 * time.Minute},
+		{http.StatusTooManyRequests, "-5", 0},
+		{http.StatusTooManyRequests, "soon", 0},
+		{http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+		// only 429 and 503 say when to come back
+		{http.StatusInternalServerError, "30", 0},
+		{http.StatusBadGateway, "30", 0},
+	}
+	for _, test := range tests {
+		response := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		if test.retryAfter != "" {
+			response.Header.Set("Retry-After", test.retryAfter)
+		}
+		if got := parseRetryAfter(response); got != test.want {
+			t.Errorf("parseRetryAfter(%d, %q) = %s, want %s", test.status, test.retryAfter, got, test.want)
+		}
+	}
+}
+
+func TestParseRetryAfterDate(t *testing.T) {
+	response := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	response.Header.Set("Retry-After", time.Now().Add(90*time.Second).UTC().Format(http.TimeFormat))
+	// The date has a resolution of a second
+	if got := parseRetryAfter(response); got < 88*time.Second || got > 90*time.Second {
+		t.Errorf("parseRetryAfter(in 90s) = %s", got)
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestEntityTooLarge, false},
+		{http.StatusNotImplemented, false},
+	}
+	for _, test := range tests {
+		if got := isRetryableStatus(test.status); got != test.want {
+			t.Errorf("isRetryableStatus(%d) = %v, want %v", test.status, got, test.want)
+		}
+	}
+}
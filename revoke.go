@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+type RevokeResult struct {
+	Schema     int    `json:"schema"`
+	Command    string `json:"command"`
+	TransferId string `json:"transfer_id,omitempty"`
+	// "revoked" or "already_gone"
+	Result string `json:"result"`
+}
+
+// revokeTransfer deletes a transfer from the server. The reference is a
+// management token, or the id or link of a transfer in the history.
+func revokeTransfer(ctx context.Context, reference string, options *Options) RevokeResult {
+	result := RevokeResult{
+		Schema:  outputSchemaVersion,
+		Command: "revoke",
+	}
+	token := reference
+	entry, found := findHistoryEntry(reference)
+	if found {
+		token = entry.ManagementToken
+		result.TransferId = entry.Id
+		activeProfile.BaseUrl = entry.BaseUrl
+	} else if strings.Contains(reference, "/") {
+		fatal("The link is not in the history, please use the management token printed by encrypt")
+	}
+	checkAllowedServer(activeProfile.BaseUrl)
+
+	if !options.Yes && !confirmRevoke(entry, found) {
+		fatal("Cancelled")
+	}
+
+	err := deleteTransfer(ctx, token)
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) && isGoneStatus(statusErr.StatusCode) {
+		result.Result = "already_gone"
+		return result
+	}
+	if err != nil {
+		panic(err)
+	}
+	result.Result = "revoked"
+	if found {
+		markRevoked(entry.Id)
+	}
+	return result
+}
+
+func confirmRevoke(entry HistoryEntry, found bool) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fatal("Refusing to revoke without confirmation, use --yes")
+	}
+	if found {
+		fmt.Fprintf(os.Stderr, "Transfer %s, created %s, with:\n", entry.Id, entry.CreatedAt.Local().Format("2006-01-02 15:04"))
+		for _, file := range entry.Files {
+			fmt.Fprintln(os.Stderr, "    ", file.Name)
+		}
+	}
+	fmt.Fprint(os.Stderr, "Delete the transfer from the server? The link stops working immediately. [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printRevokeResult(result *RevokeResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	if result.Result == "already_gone" {
+		fmt.Println("The transfer had already expired or was deleted, nothing to revoke.")
+		return
+	}
+	fmt.Println("The transfer was deleted, the link does not work any more.")
+}
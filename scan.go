@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScanClean    = "clean"
+	ScanRejected = "rejected"
+	ScanError    = "error" // the scan did not run, the file is treated as rejected
+)
+
+// Upper bound for scanning one file with clamd.
+const clamdTimeout = 10 * time.Minute
+
+// ScanContext describes the transfer of the scanned files to the scan command.
+type ScanContext struct {
+	TransferId  string
+	Description string
+	Signer      *SignerResult
+}
+
+// isScanEnabled tells whether downloaded files are scanned.
+func isScanEnabled() bool {
+	return activeProfile.ScanCommand != "" || activeProfile.Clamd != ""
+}
+
+// scanFiles scans every downloaded file with the scan command and clamd, and
+// moves the files that fail either of them to the quarantine directory.
+func scanFiles(ctx context.Context, files []DecryptFileResult, scanContext *ScanContext) {
+	if !isScanEnabled() {
+		return
+	}
+	for i := range files {
+		file := &files[i]
+		if file.Path == "" {
+			continue
+		}
+		status, detail := scanFile(ctx, file, scanContext)
+		if ctx.Err() != nil {
+			panic(ctx.Err())
+		}
+		file.ScanStatus = status
+		file.ScanDetail = detail
+		if status == ScanClean {
+			fmt.Fprintf(humanOut, "%s: scan clean\n", file.Path)
+			continue
+		}
+		quarantined, err := quarantineFile(file.Path)
+		if err != nil {
+			// Deleting it would lose the evidence, the exit code still rejects it
+			fmt.Fprintf(os.Stderr, "%s: scan %s (%s), could not move it to the quarantine, left it in place: %v\n", file.Path, status, detail, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: scan %s (%s), moved to %s\n", file.Path, status, detail, quarantined)
+		file.Path = quarantined
+		file.Quarantined = true
+	}
+}
+
+// checkScanCommand stops decrypt before anything is downloaded when the scan
+// command can't be split into words.
+func checkScanCommand() {
+	if activeProfile.ScanCommand == "" {
+		return
+	}
+	if _, err := splitCommand(activeProfile.ScanCommand); err != nil {
+		fatal("Invalid scan command: %v", err)
+	}
+}
+
+// splitCommand splits a command line into words like a POSIX shell, with
+// single and double quotes and backslash escapes, but without expansions. A
+// backslash only escapes a space, a quote or a backslash, so Windows paths
+// can stay as they are.
+func splitCommand(line string) ([]string, error) {
+	words := make([]string, 0)
+	word := strings.Builder{}
+	inWord := false
+	quote := rune(0)
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(runes) && strings.ContainsRune(" \t\"'\\", runes[i+1]):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return words, nil
+}
+
+func scanFile(ctx context.Context, file *DecryptFileResult, scanContext *ScanContext) (string, string) {
+	if activeProfile.ScanCommand != "" {
+		status, detail := runScanCommand(ctx, file, scanContext)
+		if status != ScanClean {
+			return status, detail
+		}
+	}
+	if activeProfile.Clamd != "" {
+		return scanWithClamd(ctx, activeProfile.Clamd, file.Path)
+	}
+	return ScanClean, ""
+}
+
+// runScanCommand runs the command with the path of the file as its last
+// argument. It accepts the file by exiting with 0.
+func runScanCommand(ctx context.Context, file *DecryptFileResult, scanContext *ScanContext) (string, string) {
+	// Checked by checkScanCommand before the download
+	words, _ := splitCommand(activeProfile.ScanCommand)
+	command := exec.CommandContext(ctx, words[0], append(words[1:], file.Path)...)
+	command.Env = append(os.Environ(),
+		"SFT_FILE="+file.Path,
+		"SFT_FILE_NAME="+file.Name,
+		"SFT_FILE_SIZE="+strconv.Itoa(file.Size),
+		"SFT_CONTENT_TYPE="+file.ContentType,
+		"SFT_CHECKSUM_STATUS="+file.ChecksumStatus,
+		"SFT_TRANSFER_ID="+scanContext.TransferId,
+		"SFT_DESCRIPTION="+scanContext.Description,
+	)
+	if signer := scanContext.Signer; signer != nil {
+		command.Env = append(command.Env,
+			"SFT_SIGNER="+signer.PublicKey,
+			"SFT_SIGNER_NAME="+signer.Name,
+			"SFT_SIGNER_TRUSTED="+strconv.FormatBool(signer.Trusted),
+		)
+	}
+	output, err := command.CombinedOutput()
+	detail := lastLine(output)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if detail == "" {
+			detail = exitErr.Error()
+		}
+		return ScanRejected, detail
+	}
+	if err != nil {
+		return ScanError, err.Error()
+	}
+	return ScanClean, detail
+}
+
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// scanWithClamd streams the file to clamd with INSTREAM. The address is a
+// unix socket ("/run/clamav/clamd.ctl" or "unix:...") or host:port.
+func scanWithClamd(ctx context.Context, address string, path string) (string, string) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+	}
+	ctx, cancel := context.WithTimeout(ctx, clamdTimeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return ScanError, err.Error()
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reply, err := clamdInstream(conn, path)
+	if err != nil {
+		return ScanError, err.Error()
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanClean, ""
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanRejected, strings.TrimSuffix(reply, " FOUND")
+	default:
+		return ScanError, "clamd: " + reply
+	}
+}
+
+func clamdInstream(conn net.Conn, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(conn)
+	writer.WriteString("zINSTREAM\x00")
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			binary.Write(writer, binary.BigEndian, uint32(n))
+			writer.Write(buffer[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	// A chunk of length 0 ends the stream
+	binary.Write(writer, binary.BigEndian, uint32(0))
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	return string(bytes.TrimSpace(bytes.TrimRight(reply, "\x00"))), nil
+}
+
+// quarantineDir is the quarantine_dir of the profile, or "quarantine" in the
+// output directory.
+func quarantineDir() string {
+	if activeProfile.QuarantineDir != "" {
+		return activeProfile.QuarantineDir
+	}
+	return filepath.Join(activeProfile.OutputDir, "quarantine")
+}
+
+// quarantineFile moves the file to the quarantine directory and returns its
+// new path.
+func quarantineFile(path string) (string, error) {
+	dir := quarantineDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	target := findNameForFile(filepath.Join(dir, filepath.Base(path)))
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+	os.Chmod(target, 0600)
+	return target, nil
+}
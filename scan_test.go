@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"check-download", []string{"check-download"}},
+		{"  clamdscan  --no-summary\t--fdpass ", []string{"clamdscan", "--no-summary", "--fdpass"}},
+		{`"/opt/My Scanner/scan" --mode strict`, []string{"/opt/My Scanner/scan", "--mode", "strict"}},
+		{`/opt/My\ Scanner/scan`, []string{"/opt/My Scanner/scan"}},
+		{`scan --label 'it''s "fine"'`, []string{"scan", "--label", `its "fine"`}},
+		{`scan --empty ""`, []string{"scan", "--empty", ""}},
+		{`C:\Tools\scan.exe /quiet`, []string{`C:\Tools\scan.exe`, "/quiet"}},
+		{`scan "a \"quoted\" word"`, []string{"scan", `a "quoted" word`}},
+	}
+	for _, test := range tests {
+		got, err := splitCommand(test.line)
+		if err != nil {
+			t.Errorf("splitCommand(%q): %v", test.line, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestSplitCommandErrors(t *testing.T) {
+	for _, line := range []string{"", "   ", `scan "unterminated`, "scan 'unterminated"} {
+		if words, err := splitCommand(line); err == nil {
+			t.Errorf("splitCommand(%q) = %q, want an error", line, words)
+		}
+	}
+}
@@ -2,21 +2,70 @@ package main
 
 import (
 	"crypto/sha256"
+	"fmt"
 	"io"
+	"time"
 
 	"golang.org/x/crypto/hkdf"
 )
 
+const maxChunkSize = 16 * 1024 * 1024 // 16 MB
+
 type Options struct {
 	Password       bool
 	PasswordString string
 	Show           bool
 	Help           bool
+	DeleteOnCancel bool
+	Output         string
+	Profile        string
+	NoHistory      bool
+	Yes            bool
+	Split          bool
+	Manifest       string
+	Bundle         string
+	LocalFile      string
+	Description    string
+	Recipients     string
+	// Log of the API calls
+	Verbosity    int
+	LogOutput    string
+	LogFormat    string
+	IgnorePolicy bool
+	// watch
+	Settle       time.Duration
+	PollInterval time.Duration
+	DoneDir      string
+	FailedDir    string
+	LinkFiles    bool
+	LogFile      string
+	Batch        bool
+	Recipient    string
+	SeparateKey  bool
+	KeyCode      bool
+	KeyShares    string
+	Key          string
+	Shares       []string
+	// Checksums of the uploaded and downloaded files
+	ChecksumAlgorithm string
+	EmbedChecksums    bool
+	ChecksumFile      string
+	WriteChecksum     bool
+	// Webhooks in addition to those of the profile
+	Webhooks       []string
+	WebhookOmitKey bool
+	Labels         []string
+	// keygen creates a signing key
+	SigningKey bool
+	SignerName string
+	// Settings from the command line, they override the config file
+	ProfileFlags Profile
 }
 
 type Metadata struct {
-	Description string         `json:"description"`
-	Files       []UploadedFile `json:"filesMetadata"`
+	Description string             `json:"description"`
+	Files       []UploadedFile     `json:"filesMetadata"`
+	Signature   *MetadataSignature `json:"signature,omitempty"`
 }
 
 type UploadedData struct {
@@ -29,6 +78,8 @@ type UploadedFile struct {
 	Size     int            `json:"size"`
 	Chunks   []UploadedData `json:"chunks"`
 	FileType string         `json:"type"`
+	// Not part of the web client's format, it ignores the field
+	Checksums map[string]string `json:"checksums,omitempty"`
 }
 
 type MessageResponse struct {
@@ -54,3 +105,19 @@ func keysFromKeyMaterial(keyMaterial []byte) (key []byte, iv []byte) {
 	}
 	return key, iv
 }
+
+// fatalError is a problem the user has to fix. main reports it without a
+// stack trace and exits with 1, watch only fails the upload.
+type fatalError struct {
+	message string
+}
+
+func (e fatalError) Error() string {
+	return e.message
+}
+
+// fatal stops the command with a problem the user has to fix. It panics, so
+// the deferred cleanups of the callers run.
+func fatal(format string, a ...interface{}) {
+	panic(fatalError{fmt.Sprintf(format, a...)})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	signPublicKeyPrefix = "sft-sign-pub-"
+	signSecretKeyPrefix = "sft-sign-secret-"
+	signerNamePrefix    = "name: "
+)
+
+// MetadataSignature signs the rest of the metadata. The web client ignores it.
+type MetadataSignature struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+	// Chosen by the signer, only shown for trusted keys without a name
+	Signer    string `json:"signer,omitempty"`
+	Signature string `json:"signature"`
+}
+
+type SigningKey struct {
+	PrivateKey ed25519.PrivateKey
+	Name       string
+}
+
+// The key encrypt signs the metadata with, nil when not signing.
+var signingKey *SigningKey
+
+type SignerResult struct {
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+	Trusted   bool   `json:"trusted"`
+}
+
+func defaultSigningKeyPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sft", "signing-key")
+}
+
+// generateSigningKey writes a new Ed25519 key to path, never replacing an
+// existing one.
+func generateSigningKey(path string, name string) KeygenResult {
+	if path == "" {
+		path = defaultSigningKeyPath()
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	encodedPublicKey := encodeSignPublicKey(publicKey)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		panic(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		fatal("%s already exists, remove it first or choose another file", path)
+	}
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(file, "# created: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(file, "# public key: %s\n", encodedPublicKey)
+	if name != "" {
+		fmt.Fprintln(file, signerNamePrefix+name)
+	}
+	fmt.Fprintln(file, signSecretKeyPrefix+base64.RawURLEncoding.EncodeToString(privateKey.Seed()))
+	err = file.Close()
+	if err != nil {
+		panic(err)
+	}
+	return KeygenResult{
+		Schema:    outputSchemaVersion,
+		Command:   "keygen",
+		PublicKey: encodedPublicKey,
+		Identity:  path,
+	}
+}
+
+func printSigningKeygenResult(result *KeygenResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Println("Signing key saved to", result.Identity)
+	fmt.Println("Public key (recipients verify your transfers with decrypt --trust <key>):")
+	fmt.Println(result.PublicKey)
+}
+
+func encodeSignPublicKey(publicKey ed25519.PublicKey) string {
+	return signPublicKeyPrefix + base64.RawURLEncoding.EncodeToString(publicKey)
+}
+
+func parseSignPublicKey(encoded string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(encoded, signPublicKeyPrefix) {
+		return nil, fmt.Errorf("a signing public key starts with %s", signPublicKeyPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encoded, signPublicKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("wrong length")
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+func loadSigningKey(path string) (*SigningKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	key := &SigningKey{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, signerNamePrefix):
+			key.Name = strings.TrimPrefix(line, signerNamePrefix)
+		case strings.HasPrefix(line, signSecretKeyPrefix):
+			seed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, signSecretKeyPrefix))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("%s: invalid key", path)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(seed)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if key.PrivateKey == nil {
+		return nil, fmt.Errorf("%s: no %s key found", path, signSecretKeyPrefix)
+	}
+	return key, nil
+}
+
+// loadActiveSigningKey loads the sign_key of the active profile, if any.
+func loadActiveSigningKey() {
+	if activeProfile.SignKey == "" {
+		return
+	}
+	var err error
+	signingKey, err = loadSigningKey(activeProfile.SignKey)
+	if err != nil {
+		fatal("Could not read the signing key: %v", err)
+	}
+}
+
+// signedData is what the signature covers: the metadata without the signature.
+func signedData(metadata *Metadata) []byte {
+	unsigned := *metadata
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// signMetadata adds a signature with signingKey, if there is one.
+func signMetadata(metadata *Metadata) {
+	if signingKey == nil {
+		return
+	}
+	signature := ed25519.Sign(signingKey.PrivateKey, signedData(metadata))
+	metadata.Signature = &MetadataSignature{
+		Algorithm: "ed25519",
+		PublicKey: encodeSignPublicKey(signingKey.PrivateKey.Public().(ed25519.PublicKey)),
+		Signer:    signingKey.Name,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+// trustedKeys reads the trust list of the active profile. An entry is a
+// public key or a file with one "<key> [name]" per line.
+func trustedKeys() map[string]string {
+	trusted := map[string]string{}
+	for _, entry := range activeProfile.Trust {
+		if strings.HasPrefix(entry, signPublicKeyPrefix) {
+			trusted[entry] = ""
+			continue
+		}
+		data, err := os.ReadFile(expandHome(entry))
+		if err != nil {
+			fatal("Could not read the trusted keys: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if !strings.HasPrefix(fields[0], signPublicKeyPrefix) {
+				continue
+			}
+			name := ""
+			if len(fields) == 2 {
+				name = strings.TrimSpace(fields[1])
+			}
+			trusted[fields[0]] = name
+		}
+	}
+	return trusted
+}
+
+// verifySignature checks the signature of the metadata before anything is
+// downloaded. Invalid signatures are refused. With trusted keys configured,
+// so are unsigned transfers and other signers, without them a signer is
+// only reported.
+func verifySignature(metadata *Metadata) *SignerResult {
+	trusted := trustedKeys()
+	signature := metadata.Signature
+	if signature == nil {
+		if len(trusted) > 0 {
+			fatal("The transfer is not signed, refusing it")
+		}
+		return nil
+	}
+	publicKey, err := parseSignPublicKey(signature.PublicKey)
+	if err != nil || signature.Algorithm != "ed25519" {
+		fatal("The transfer has an invalid signature, refusing it")
+	}
+	value, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil || !ed25519.Verify(publicKey, signedData(metadata), value) {
+		fatal("The transfer has an invalid signature, refusing it")
+	}
+	name, ok := trusted[signature.PublicKey]
+	result := &SignerResult{signature.PublicKey, name, ok}
+	if result.Name == "" {
+		result.Name = signature.Signer
+	}
+	switch {
+	case ok:
+		fmt.Fprintf(humanOut, "Signed by %s\n", signerLabel(result))
+	case len(trusted) > 0:
+		fatal("The transfer is signed by an untrusted key %s, refusing it", signerLabel(result))
+	default:
+		printStatus("Warning: signed by %s, the key is not trusted", signerLabel(result))
+	}
+	return result
+}
+
+func signerLabel(signer *SignerResult) string {
+	if signer.Name == "" {
+		return signer.PublicKey
+	}
+	return fmt.Sprintf("%s (%s)", signer.Name, signer.PublicKey)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// Version of the manifest written by encrypt --split.
+const manifestVersion = 1
+
+// SplitManifest lists the transfers of a split upload and how the original
+// files are put together from their parts. It contains the links, so it is
+// as secret as a link.
+type SplitManifest struct {
+	Version           int            `json:"sft_manifest"`
+	Links             []string       `json:"links"`
+	ChecksumAlgorithm string         `json:"checksum_algorithm,omitempty"`
+	Files             []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name     string         `json:"name"`
+	Size     int64          `json:"size"`
+	Checksum string         `json:"checksum,omitempty"`
+	Parts    []ManifestPart `json:"parts"`
+}
+
+// ManifestPart is the file at position File of the transfer at position
+// Transfer of the links.
+type ManifestPart struct {
+	Transfer int    `json:"transfer"`
+	File     int    `json:"file"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+}
+
+type SplitEncryptResult struct {
+	Schema            int             `json:"schema"`
+	Command           string          `json:"command"`
+	Manifest          string          `json:"manifest"`
+	Transfers         []EncryptResult `json:"transfers"`
+	ChecksumAlgorithm string          `json:"checksum_algorithm"`
+	// The original files, before splitting
+	Files []EncryptFileResult `json:"files"`
+}
+
+// planSplit distributes the pieces over transfers that each fit in maxSize.
+// Files too big for a transfer of their own are cut into parts, the others
+// are kept whole.
+func planSplit(pieces []UploadPiece, maxSize int64) [][]UploadPiece {
+	// The parts of a file are found by its path in the manifest
+	paths := map[string]bool{}
+	for _, piece := range pieces {
+		path, err := filepath.Abs(piece.Path)
+		if err != nil {
+			panic(err)
+		}
+		if paths[path] {
+			fatal("%s is given more than once", piece.Path)
+		}
+		paths[path] = true
+	}
+	fits := func(pieces []UploadPiece) bool {
+		return computeUploadSize(pieces).total() <= maxSize
+	}
+	transfers := make([][]UploadPiece, 0)
+	current := make([]UploadPiece, 0)
+	closeTransfer := func() {
+		transfers = append(transfers, current)
+		current = make([]UploadPiece, 0)
+	}
+	for _, piece := range pieces {
+		if fits(append(slices.Clip(current), piece)) {
+			current = append(current, piece)
+			continue
+		}
+		if fits([]UploadPiece{piece}) {
+			closeTransfer()
+			current = append(current, piece)
+			continue
+		}
+		for part, offset := 1, int64(0); offset < piece.Size; part++ {
+			candidate := piece
+			candidate.Name = fmt.Sprintf("%s.part%d", piece.Name, part)
+			candidate.Offset = offset
+			size := largestFit(current, candidate, piece.Size-offset, maxSize)
+			if size == 0 && len(current) == 0 {
+				fatal("The maximum upload size of %s is too small to split %s", formatBytes(maxSize), piece.Name)
+			}
+			if size == 0 {
+				closeTransfer()
+				part--
+				continue
+			}
+			candidate.Size = size
+			current = append(current, candidate)
+			offset += size
+			if offset < piece.Size {
+				closeTransfer()
+			}
+		}
+	}
+	if len(current) > 0 {
+		closeTransfer()
+	}
+	return transfers
+}
+
+// largestFit returns the biggest size up to limit of candidate that still
+// fits in a transfer next to current, or 0 if nothing does.
+func largestFit(current []UploadPiece, candidate UploadPiece, limit int64, maxSize int64) int64 {
+	low, high := int64(0), limit
+	for low < high {
+		candidate.Size = (low + high + 1) / 2
+		if computeUploadSize(append(slices.Clip(current), candidate)).total() <= maxSize {
+			low = candidate.Size
+		} else {
+			high = candidate.Size - 1
+		}
+	}
+	return low
+}
+
+func encryptSplit(ctx context.Context, pieces []UploadPiece, maxSize int64, options *Options) SplitEncryptResult {
+	plan := planSplit(pieces, maxSize)
+	printStatus("The files are split into %d transfers of at most %s", len(plan), formatBytes(maxSize))
+	readPasswordIfNeeded(options)
+	result := SplitEncryptResult{
+		Schema:            outputSchemaVersion,
+		Command:           "encrypt",
+		Transfers:         make([]EncryptResult, 0),
+		ChecksumAlgorithm: options.ChecksumAlgorithm,
+		Files:             make([]EncryptFileResult, 0),
+	}
+	for i, transferPieces := range plan {
+		printStatus("Transfer %d of %d", i+1, len(plan))
+		transfer := encryptTransfer(ctx, transferPieces, computeUploadSize(transferPieces), options)
+		result.Transfers = append(result.Transfers, transfer)
+	}
+
+	manifest := newManifest(pieces, plan, result.Transfers)
+	for _, file := range manifest.Files {
+		chunks := 0
+		for _, part := range file.Parts {
+			chunks += numChunks(part.Size)
+		}
+		contentType := plan[file.Parts[0].Transfer][file.Parts[0].File].ContentType
+		result.Files = append(result.Files, EncryptFileResult{file.Name, int(file.Size), contentType, chunks, file.Checksum})
+	}
+	result.Manifest = options.Manifest
+	if result.Manifest == "" {
+		result.Manifest = "sft-manifest-" + result.Transfers[0].TransferId + ".json"
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(result.Manifest, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func newManifest(pieces []UploadPiece, plan [][]UploadPiece, transfers []EncryptResult) SplitManifest {
+	manifest := SplitManifest{
+		Version:           manifestVersion,
+		Links:             make([]string, 0),
+		ChecksumAlgorithm: pieces[0].Checksum.Algorithm,
+		Files:             make([]ManifestFile, 0),
+	}
+	// path -> position in manifest.Files
+	positions := map[string]int{}
+	for _, piece := range pieces {
+		positions[piece.Path] = len(manifest.Files)
+		manifest.Files = append(manifest.Files, ManifestFile{
+			piece.Name,
+			piece.Size,
+			piece.Checksum.sum(),
+			make([]ManifestPart, 0),
+		})
+	}
+	for i, transferPieces := range plan {
+		manifest.Links = append(manifest.Links, transfers[i].Link)
+		for j, piece := range transferPieces {
+			file := &manifest.Files[positions[piece.Path]]
+			file.Parts = append(file.Parts, ManifestPart{i, j, piece.Name, piece.Size})
+		}
+	}
+	return manifest
+}
+
+func printSplitResult(result *SplitEncryptResult) {
+	if outputFormat != OutputText {
+		emitResult(result)
+		return
+	}
+	fmt.Printf("Successfully encrypted and uploaded the file(s) as %d transfers\n", len(result.Transfers))
+	for i, transfer := range result.Transfers {
+		fmt.Println("")
+		fmt.Printf("Transfer %d download url:\n", i+1)
+		fmt.Println(transfer.Link)
+		fmt.Println("Management token:")
+		fmt.Println(transfer.ManagementToken)
+	}
+	fmt.Println("")
+	fmt.Println("Manifest (download everything with 'sft decrypt <manifest>'):")
+	fmt.Println(result.Manifest)
+	fmt.Println("")
+	printChecksums(result.ChecksumAlgorithm, result.Files)
+}
+
+// isManifest tells a manifest file apart from a download link.
+func isManifest(argument string) bool {
+	return !strings.Contains(argument, "://")
+}
+
+func readManifest(path string) SplitManifest {
+	manifest := SplitManifest{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fatal("Could not read the manifest: %v", err)
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		fatal("%s is not a manifest: %v", path, err)
+	}
+	if manifest.Version != manifestVersion {
+		fatal("%s is not a manifest of a supported version", path)
+	}
+	return manifest
+}
+
+// ManifestTransfer is a transfer of a manifest, ready to be downloaded.
+type ManifestTransfer struct {
+	BaseUrl       string
+	Id            string
+	DownloadToken string
+	Files         []FileInfo
+}
+
+type ManifestDecryptResult struct {
+	Schema      int                 `json:"schema"`
+	Command     string              `json:"command"`
+	Manifest    string              `json:"manifest"`
+	TransferIds []string            `json:"transfer_ids"`
+	Downloaded  bool                `json:"downloaded"`
+	Files       []DecryptFileResult `json:"files"`
+}
+
+// decryptManifest downloads every transfer of a split upload and puts the
+// original files back together. Nothing is downloaded unless all the parts
+// are still available.
+func decryptManifest(ctx context.Context, path string, options *Options) ManifestDecryptResult {
+	checkWebhookOptions(options)
+	checkScanCommand()
+	published := readPublishedChecksums(options)
+	manifest := readManifest(path)
+	transfers := make([]ManifestTransfer, 0)
+	problems := make([]string, 0)
+	for i, link := range manifest.Links {
+		transfer, err := openManifestTransfer(ctx, link)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("transfer %d: %v", i+1, err))
+		}
+		transfers = append(transfers, transfer)
+	}
+	problems = append(problems, checkManifest(&manifest, transfers)...)
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, "Parts of the manifest are missing:")
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "  "+problem)
+		}
+		fatal("The files can't be put together")
+	}
+
+	result := ManifestDecryptResult{
+		Schema:      outputSchemaVersion,
+		Command:     "decrypt",
+		Manifest:    path,
+		TransferIds: make([]string, 0),
+		Downloaded:  !options.Show,
+		Files:       make([]DecryptFileResult, 0),
+	}
+	for _, transfer := range transfers {
+		result.TransferIds = append(result.TransferIds, transfer.Id)
+	}
+	for _, file := range manifest.Files {
+		result.Files = append(result.Files, manifestFileResult(&file, transfers))
+	}
+	if options.Show {
+		printManifestFiles(&manifest, result.Files)
+		return result
+	}
+
+	if activeProfile.OutputDir != "" {
+		err := os.MkdirAll(activeProfile.OutputDir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	totalSize := int64(0)
+	for _, file := range manifest.Files {
+		totalSize += file.Size
+	}
+	transferProgress := newTransferProgress("Downloading", "Downloaded", totalSize)
+	expected := make([]map[string]string, 0)
+	for i, file := range manifest.Files {
+		sender := map[string]string{}
+		if file.Checksum != "" {
+			sender[manifest.ChecksumAlgorithm] = file.Checksum
+		}
+		want := expectedChecksums(file.Name, sender, published)
+		expected = append(expected, want)
+		downloaded := downloadManifestFile(ctx, &manifest.Files[i], want, transfers, transferProgress)
+		result.Files[i].Path = downloaded.Path
+		result.Files[i].Checksums = downloaded.Checksums
+		result.Files[i].Written = downloaded.Written
+	}
+	transferProgress.finish()
+	for _, transfer := range transfers {
+		activeProfile.BaseUrl = transfer.BaseUrl
+		finalizeDownload(ctx, transfer.Files, transfer.DownloadToken)
+	}
+	fmt.Fprintln(humanOut, "Successfully downloaded all file(s).")
+	verifyChecksums(result.Files, expected, options)
+	scanFiles(ctx, result.Files, &ScanContext{TransferId: strings.Join(result.TransferIds, ",")})
+	notifyDownload(ctx, result.TransferIds, result.Files, options)
+	return result
+}
+
+func openManifestTransfer(ctx context.Context, link string) (ManifestTransfer, error) {
+	baseUrl, id, key := parseUrl(link)
+	checkAllowedServer(baseUrl)
+	activeProfile.BaseUrl = baseUrl
+	transfer := ManifestTransfer{BaseUrl: baseUrl, Id: id}
+	transferInfo, err := requestDownload(ctx, id)
+	if err != nil {
+		var statusErr *HttpStatusError
+		if errors.As(err, &statusErr) && isGoneStatus(statusErr.StatusCode) {
+			return transfer, fmt.Errorf("%s expired or was deleted", id)
+		}
+		panic(err)
+	}
+	transfer.DownloadToken = transferInfo.DownloadToken
+	metadata := downloadMetadata(ctx, &transferInfo, key)
+	verifySignature(&metadata)
+	transfer.Files = validateFiles(ctx, metadata.Files, transferInfo.DownloadToken)
+	return transfer, nil
+}
+
+// checkManifest returns what is missing to put the files of the manifest
+// together.
+func checkManifest(manifest *SplitManifest, transfers []ManifestTransfer) []string {
+	problems := make([]string, 0)
+	for _, file := range manifest.Files {
+		total := int64(0)
+		for _, part := range file.Parts {
+			total += part.Size
+			if part.Transfer < 0 || part.Transfer >= len(transfers) {
+				problems = append(problems, fmt.Sprintf("%s: no transfer %d in the manifest", part.Name, part.Transfer+1))
+				continue
+			}
+			files := transfers[part.Transfer].Files
+			if transfers[part.Transfer].DownloadToken == "" {
+				continue
+			}
+			if part.File < 0 || part.File >= len(files) || files[part.File].Name != part.Name {
+				problems = append(problems, fmt.Sprintf("%s: not found in transfer %d", part.Name, part.Transfer+1))
+				continue
+			}
+			if int64(files[part.File].Size) != part.Size {
+				problems = append(problems, fmt.Sprintf("%s: %d bytes instead of %d", part.Name, files[part.File].Size, part.Size))
+			}
+		}
+		if total != file.Size {
+			problems = append(problems, fmt.Sprintf("%s: the parts add up to %d bytes instead of %d", file.Name, total, file.Size))
+		}
+	}
+	return problems
+}
+
+// manifestFileResult describes a file of the manifest. A file can be
+// downloaded as often as its most downloaded part.
+func manifestFileResult(file *ManifestFile, transfers []ManifestTransfer) DecryptFileResult {
+	result := DecryptFileResult{
+		Name: file.Name,
+		Size: int(file.Size),
+	}
+	for i, part := range file.Parts {
+		info := transfers[part.Transfer].Files[part.File]
+		if i == 0 {
+			result.ContentType = info.FileType
+			result.RemainingDownloads = info.RemainingCount
+		}
+		result.Chunks += len(info.Chunks)
+		result.DownloadCount = max(result.DownloadCount, info.DownloadCount)
+		result.RemainingDownloads = min(result.RemainingDownloads, info.RemainingCount)
+	}
+	return result
+}
+
+func printManifestFiles(manifest *SplitManifest, files []DecryptFileResult) {
+	t := table.NewWriter()
+	t.SetOutputMirror(humanOut)
+	t.SetTitle(fmt.Sprintf("Files in %d transfers", len(manifest.Links)))
+	t.AppendHeader(table.Row{"#", "Name", "Downloads", "Size (bytes)", "Parts", "FileType"})
+	for i, file := range files {
+		t.AppendRow(table.Row{i, file.Name, file.RemainingDownloads, file.Size, len(manifest.Files[i].Parts), file.ContentType})
+	}
+	t.Render()
+}
+
+func downloadManifestFile(ctx context.Context, file *ManifestFile, expected map[string]string, transfers []ManifestTransfer, transferProgress *TransferProgress) DownloadedFile {
+	// The name comes from the sender, never let it point outside the output directory
+	name := filepath.Join(activeProfile.OutputDir, filepath.Base(file.Name))
+	target := findNameForFile(name)
+	if target != name {
+		printStatus("Saving %s as %s", file.Name, target)
+	}
+	fileProgress := transferProgress.startFile(target, file.Size)
+	f, err := os.Create(target)
+	if err != nil {
+		panic(err)
+	}
+	completed := false
+	defer func() {
+		f.Close()
+		// Never leave a half written file behind
+		if !completed {
+			os.Remove(target)
+		}
+	}()
+	checksummer := downloadChecksummer(expected)
+	counter := &countingWriter{writer: f}
+	for _, part := range file.Parts {
+		transfer := &transfers[part.Transfer]
+		activeProfile.BaseUrl = transfer.BaseUrl
+		writeChunks(ctx, &transfer.Files[part.File], transfer.DownloadToken, fileProgress, io.MultiWriter(counter, checksummer))
+	}
+	completed = true
+	fileProgress.finish()
+	return DownloadedFile{target, checksummer.sums(), counter.count}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testPieces(sizes ...int64) []UploadPiece {
+	pieces := make([]UploadPiece, 0)
+	for i, size := range sizes {
+		name := fmt.Sprintf("file%d.bin", i+1)
+		pieces = append(pieces, UploadPiece{Path: "/data/" + name, Name: name, Size: size, ContentType: "application/octet-stream"})
+	}
+	return pieces
+}
+
+func TestPlanSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []int64
+		maxSize int64
+		// names of the pieces of every transfer
+		want [][]string
+	}{
+		{
+			name:    "everything fits",
+			sizes:   []int64{100, 200, 300},
+			maxSize: 10000,
+			want:    [][]string{{"file1.bin", "file2.bin", "file3.bin"}},
+		},
+		{
+			name:    "whole files in separate transfers",
+			sizes:   []int64{3000, 3000},
+			maxSize: 4000,
+			want:    [][]string{{"file1.bin"}, {"file2.bin"}},
+		},
+		{
+			name:    "small files fill a transfer",
+			sizes:   []int64{2000, 3000, 500},
+			maxSize: 4000,
+			want:    [][]string{{"file1.bin"}, {"file2.bin", "file3.bin"}},
+		},
+		{
+			name:    "a big file in parts",
+			sizes:   []int64{9000},
+			maxSize: 4000,
+			want:    [][]string{{"file1.bin.part1"}, {"file1.bin.part2"}, {"file1.bin.part3"}},
+		},
+		{
+			name:    "the first part goes next to a small file",
+			sizes:   []int64{1000, 5000},
+			maxSize: 4000,
+			want:    [][]string{{"file1.bin", "file2.bin.part1"}, {"file2.bin.part2"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pieces := testPieces(test.sizes...)
+			transfers := planSplit(pieces, test.maxSize)
+			got := make([][]string, 0)
+			for _, transfer := range transfers {
+				names := make([]string, 0)
+				for _, piece := range transfer {
+					names = append(names, piece.Name)
+				}
+				got = append(got, names)
+			}
+			if !slices.EqualFunc(got, test.want, slices.Equal[[]string]) {
+				t.Fatalf("planSplit = %v, want %v", got, test.want)
+			}
+			checkSplitPlan(t, pieces, transfers, test.maxSize)
+		})
+	}
+}
+
+// checkSplitPlan verifies that every transfer fits and the pieces of every
+// file cover it in order without gaps.
+func checkSplitPlan(t *testing.T, pieces []UploadPiece, transfers [][]UploadPiece, maxSize int64) {
+	t.Helper()
+	next := map[string]int64{}
+	for i, transfer := range transfers {
+		if size := computeUploadSize(transfer).total(); size > maxSize {
+			t.Errorf("transfer %d is %d bytes, more than %d", i+1, size, maxSize)
+		}
+		for _, piece := range transfer {
+			if piece.Offset != next[piece.Path] {
+				t.Errorf("%s starts at %d, want %d", piece.Name, piece.Offset, next[piece.Path])
+			}
+			if piece.Size <= 0 {
+				t.Errorf("%s is empty", piece.Name)
+			}
+			next[piece.Path] = piece.Offset + piece.Size
+		}
+	}
+	for _, piece := range pieces {
+		if next[piece.Path] != piece.Size {
+			t.Errorf("%s is covered up to %d of %d", piece.Name, next[piece.Path], piece.Size)
+		}
+	}
+}
+
+func TestPlanSplitRefuses(t *testing.T) {
+	duplicate := testPieces(100, 100)
+	duplicate[1].Path = duplicate[0].Path
+	tests := []struct {
+		name    string
+		pieces  []UploadPiece
+		maxSize int64
+		want    string
+	}{
+		{"file given twice", duplicate, 10000, "given more than once"},
+		{"no room for data", testPieces(1000), 100, "too small to split"},
+	}
+	for _, test := range tests {
+		message := fatalMessage(func() { planSplit(test.pieces, test.maxSize) })
+		if !strings.Contains(message, test.want) {
+			t.Errorf("%s: fatal %q, want %q", test.name, message, test.want)
+		}
+	}
+}
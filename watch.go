@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSettle       = 5 * time.Second
+	defaultPollInterval = 10 * time.Second
+)
+
+// WatchLogEntry is a line of the --log file, one per upload.
+type WatchLogEntry struct {
+	Time            time.Time `json:"time"`
+	Status          string    `json:"status"` // "uploaded" or "failed"
+	Files           []string  `json:"files"`
+	Link            string    `json:"link,omitempty"`
+	TransferId      string    `json:"transfer_id,omitempty"`
+	ManagementToken string    `json:"management_token,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// watchedFile is a file that is possibly still being written.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// when the size or the modification time changed the last time
+	since time.Time
+}
+
+// watchFolder uploads the files that appear in dir until ctx is cancelled.
+// A file is taken once its size and modification time didn't change for the
+// settle delay, and moved to the done or failed directory afterwards.
+func watchFolder(ctx context.Context, dir string, options *Options) {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		fatal("%s is not a directory", dir)
+	}
+	if options.Settle <= 0 {
+		options.Settle = defaultSettle
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultPollInterval
+	}
+	if options.DoneDir == "" {
+		options.DoneDir = filepath.Join(dir, "done")
+	}
+	if options.FailedDir == "" {
+		options.FailedDir = filepath.Join(dir, "failed")
+	}
+	for _, target := range []string{options.DoneDir, options.FailedDir} {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			fatal("Could not create %s: %v", target, err)
+		}
+	}
+	// Check the options once instead of failing every file
+	recipientKey(options)
+	checkWebhookOptions(options)
+	enforceTransferPolicy(options)
+	if !isValidChecksumAlgorithm(options.ChecksumAlgorithm) {
+		fatal("Unknown checksum algorithm: %s", options.ChecksumAlgorithm)
+	}
+	loadActiveSigningKey()
+	if signingKey != nil {
+		options.EmbedChecksums = true
+	}
+
+	// Polling is the fallback, with inotify the events and the settle timer
+	// drive the loop
+	var poll <-chan time.Time
+	var ticker *time.Ticker
+	startPolling := func() {
+		ticker = time.NewTicker(options.PollInterval)
+		poll = ticker.C
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	events, err := watchDirectory(dir)
+	if err != nil {
+		printStatus("Watching %s, checking every %s (%v)", dir, options.PollInterval, err)
+		startPolling()
+	} else {
+		printStatus("Watching %s", dir)
+	}
+	// Fires when the first pending file may have settled
+	settleTimer := time.NewTimer(options.Settle)
+	defer settleTimer.Stop()
+	pending := map[string]*watchedFile{}
+	// Files that could be moved neither to done nor to failed
+	stuck := map[string]bool{}
+	for {
+		ready := scanWatchedDir(dir, pending, stuck, options.Settle)
+		if options.Batch && len(ready) > 0 {
+			uploadWatched(ctx, ready, stuck, options)
+		} else {
+			for _, path := range ready {
+				uploadWatched(ctx, []string{path}, stuck, options)
+			}
+		}
+		resetSettleTimer(settleTimer, pending, options.Settle)
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll:
+		case <-settleTimer.C:
+		case _, ok := <-events:
+			if !ok {
+				printStatus("Watching %s stopped working, checking every %s", dir, options.PollInterval)
+				events = nil
+				startPolling()
+			}
+		}
+	}
+}
+
+// resetSettleTimer sets the timer to when the first pending file settles if
+// it doesn't change, and stops it when nothing is pending.
+func resetSettleTimer(timer *time.Timer, pending map[string]*watchedFile, settle time.Duration) {
+	if !timer.Stop() {
+		// Drain a value that fired while the directory was scanned
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	first := time.Time{}
+	for _, file := range pending {
+		if first.IsZero() || file.since.Before(first) {
+			first = file.since
+		}
+	}
+	timer.Reset(max(time.Until(first.Add(settle)), 0))
+}
+
+// isWatchedName skips hidden files, the sidecar files and the usual names of
+// files that are still being copied.
+func isWatchedName(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".link", ".part", ".partial", ".tmp", ".crdownload":
+		return false
+	}
+	return true
+}
+
+// scanWatchedDir updates pending with the files of dir and returns the ones
+// that settled, they are no longer pending. The stuck files are skipped.
+func scanWatchedDir(dir string, pending map[string]*watchedFile, stuck map[string]bool, settle time.Duration) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		printStatus("Could not read %s: %v", dir, err)
+		return nil
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	ready := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isWatchedName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if stuck[path] {
+			continue
+		}
+		seen[path] = true
+		file, ok := pending[path]
+		if !ok || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+			pending[path] = &watchedFile{info.Size(), info.ModTime(), now}
+			continue
+		}
+		if now.Sub(file.since) >= settle {
+			ready = append(ready, path)
+			delete(pending, path)
+		}
+	}
+	for path := range pending {
+		if !seen[path] {
+			delete(pending, path)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// tryEncryptTransfer uploads the files, returning what went wrong instead of
+// stopping the watch, also the problems encrypt reports with fatal. An
+// interruption still stops it.
+func tryEncryptTransfer(ctx context.Context, paths []string, options *Options) (result EncryptResult, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			panic(r)
+		}
+		err = fmt.Errorf("%v", r)
+	}()
+	blocking, _, err := policyViolations(paths, options)
+	if err != nil {
+		return result, err
+	}
+	if len(blocking) > 0 {
+		return result, fmt.Errorf("%s %s", filepath.Base(blocking[0].Path), blocking[0].Problem)
+	}
+	pieces := wholeFiles(paths, options)
+	uploadSize := computeUploadSize(pieces)
+	maxSize, _ := getMaxUploadSize(ctx)
+	if uploadSize.total() > maxSize {
+		return result, fmt.Errorf("the upload is %s, the server accepts %s", formatBytes(uploadSize.total()), formatBytes(maxSize))
+	}
+	return encryptTransfer(ctx, pieces, uploadSize, options), nil
+}
+
+func uploadWatched(ctx context.Context, paths []string, stuck map[string]bool, options *Options) {
+	entry := WatchLogEntry{
+		Time:  time.Now().UTC(),
+		Files: make([]string, 0),
+	}
+	for _, path := range paths {
+		entry.Files = append(entry.Files, filepath.Base(path))
+	}
+	names := strings.Join(entry.Files, ", ")
+	result, err := tryEncryptTransfer(ctx, paths, options)
+	target := options.DoneDir
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
+		target = options.FailedDir
+		fmt.Fprintf(os.Stderr, "Could not upload %s: %v\n", names, err)
+	} else {
+		entry.Status = "uploaded"
+		entry.Link = result.Link
+		entry.TransferId = result.TransferId
+		entry.ManagementToken = result.ManagementToken
+		fmt.Fprintf(humanOut, "Uploaded %s: %s\n", names, result.Link)
+	}
+	for _, path := range paths {
+		moved, err := moveWatched(path, target)
+		if err != nil && target != options.FailedDir && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Could not move %s to %s: %v\n", path, target, err)
+			moved, err = moveWatched(path, options.FailedDir)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "%s disappeared before it could be moved\n", path)
+			continue
+		}
+		if err != nil {
+			// A file that can't be moved would be uploaded again and again
+			fmt.Fprintf(os.Stderr, "Could not move %s to %s, skipping it from now on: %v\n", path, options.FailedDir, err)
+			stuck[path] = true
+			continue
+		}
+		if entry.Status == "uploaded" && options.LinkFiles && filepath.Dir(moved) == filepath.Clean(options.DoneDir) {
+			err := os.WriteFile(moved+".link", []byte(result.Link+"\n"), 0600)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not write %s.link: %v\n", moved, err)
+			}
+		}
+	}
+	emitEvent("watch_"+entry.Status, map[string]interface{}{
+		"files":       entry.Files,
+		"link":        entry.Link,
+		"transfer_id": entry.TransferId,
+		"error":       entry.Error,
+	})
+	if options.LogFile != "" {
+		appendWatchLog(options.LogFile, &entry)
+	}
+}
+
+// moveWatched moves the file to dir under a free name and returns its new
+// path.
+func moveWatched(path string, dir string) (string, error) {
+	moved := findNameForFile(filepath.Join(dir, filepath.Base(path)))
+	return moved, os.Rename(path, moved)
+}
+
+// appendWatchLog adds a JSON line to the log. It contains links, so only the
+// user can read it.
+func appendWatchLog(path string, entry *WatchLogEntry) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write to %s: %v\n", path, err)
+		return
+	}
+	defer file.Close()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write to %s: %v\n", path, err)
+	}
+}
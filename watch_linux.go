@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// watchDirectory signals changes of dir with inotify. Bursts of events are
+// merged, the caller scans the directory anyway.
+func watchDirectory(dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := syscall.Read(fd, buffer)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				close(events)
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
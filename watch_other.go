@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// watchDirectory is only implemented with inotify, watch polls elsewhere.
+func watchDirectory(dir string) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	WebhookUpload   = "upload"
+	WebhookDownload = "download"
+)
+
+// Upper bound for a webhook including its retries, the transfer is done.
+const webhookTimeout = 2 * time.Minute
+
+// Webhook is a [[profiles.<name>.webhooks]] table of the config file.
+type Webhook struct {
+	Url string `toml:"url"`
+	// upload, download or both when empty
+	Events []string `toml:"events"`
+	// Send the link without its key
+	OmitKey bool `toml:"omit_key"`
+	// text/template of the body, the JSON payload without one
+	Template     string            `toml:"template"`
+	TemplateFile string            `toml:"template_file"`
+	ContentType  string            `toml:"content_type"`
+	Headers      map[string]string `toml:"headers"`
+	Labels       map[string]string `toml:"labels"`
+	// Attempts after the first one, default 3
+	Retries int `toml:"retries"`
+}
+
+// WebhookPayload is the body of a webhook without a template, and the data
+// of the template otherwise.
+type WebhookPayload struct {
+	Schema             int               `json:"schema"`
+	Event              string            `json:"event"` // "upload" or "download"
+	Command            string            `json:"command"`
+	Time               time.Time         `json:"time"`
+	TransferId         string            `json:"transfer_id,omitempty"`
+	TransferIds        []string          `json:"transfer_ids,omitempty"` // of a manifest
+	Link               string            `json:"link,omitempty"`
+	KeyOmitted         bool              `json:"key_omitted"`
+	Label              string            `json:"label,omitempty"` // of the recipient with --recipients
+	Files              []WebhookFile     `json:"files"`
+	DeleteAfter        string            `json:"delete_after,omitempty"`
+	ExpiresAt          string            `json:"expires_at,omitempty"`
+	DownloadLimit      int               `json:"download_limit,omitempty"`
+	RemainingDownloads int               `json:"remaining_downloads"`
+	Labels             map[string]string `json:"labels,omitempty"`
+}
+
+type WebhookFile struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// Names lists the file names, for templates.
+func (p *WebhookPayload) Names() []string {
+	names := make([]string, 0)
+	for _, file := range p.Files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+var webhookFunctions = template.FuncMap{
+	"join": strings.Join,
+	// json quotes a value for a JSON body
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// checkWebhook validates a webhook of the config file or the command line.
+func checkWebhook(webhook *Webhook) error {
+	parsed, err := url.ParseRequestURI(webhook.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid webhook url %s", webhook.Url)
+	}
+	for _, event := range webhook.Events {
+		if event != WebhookUpload && event != WebhookDownload {
+			return fmt.Errorf("webhook %s: unknown event %s", webhook.Url, event)
+		}
+	}
+	if webhook.Template != "" && webhook.TemplateFile != "" {
+		return fmt.Errorf("webhook %s: template and template_file can't be combined", webhook.Url)
+	}
+	if webhook.Template != "" {
+		if _, err := template.New("webhook").Funcs(webhookFunctions).Parse(webhook.Template); err != nil {
+			return fmt.Errorf("webhook %s: %w", webhook.Url, err)
+		}
+	}
+	return nil
+}
+
+// activeWebhooks returns the webhooks of the profile and of --webhook that
+// want the event, with the --label labels added to theirs.
+func activeWebhooks(event string, options *Options) []Webhook {
+	webhooks := make([]Webhook, 0)
+	for _, webhook := range activeProfile.Webhooks {
+		if len(webhook.Events) == 0 || slices.Contains(webhook.Events, event) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	for _, address := range options.Webhooks {
+		webhooks = append(webhooks, Webhook{Url: address, OmitKey: options.WebhookOmitKey})
+	}
+	labels := parseLabels(options.Labels)
+	for i := range webhooks {
+		merged := map[string]string{}
+		for name, value := range webhooks[i].Labels {
+			merged[name] = value
+		}
+		for name, value := range labels {
+			merged[name] = value
+		}
+		webhooks[i].Labels = merged
+	}
+	return webhooks
+}
+
+// checkWebhookOptions validates --webhook and --label before anything is
+// uploaded.
+func checkWebhookOptions(options *Options) {
+	for _, address := range options.Webhooks {
+		if err := checkWebhook(&Webhook{Url: address}); err != nil {
+			fatal("Invalid --webhook: %v", err)
+		}
+	}
+	for _, label := range options.Labels {
+		if name, _, ok := strings.Cut(label, "="); !ok || name == "" {
+			fatal("Invalid --label %s, expected name=value", label)
+		}
+	}
+}
+
+func parseLabels(values []string) map[string]string {
+	labels := map[string]string{}
+	for _, value := range values {
+		name, label, _ := strings.Cut(value, "=")
+		labels[name] = label
+	}
+	return labels
+}
+
+// notifyUpload calls the upload webhooks with a completed transfer.
+func notifyUpload(ctx context.Context, result *EncryptResult, options *Options) {
+	payload := WebhookPayload{
+		Schema:             outputSchemaVersion,
+		Event:              WebhookUpload,
+		Command:            result.Command,
+		Time:               time.Now().UTC(),
+		TransferId:         result.TransferId,
+		Link:               result.Link,
+		Label:              result.Label,
+		Files:              make([]WebhookFile, 0),
+		DeleteAfter:        result.DeleteAfter,
+		ExpiresAt:          result.ExpiresAt,
+		DownloadLimit:      result.DownloadLimit,
+		RemainingDownloads: result.DownloadLimit,
+	}
+	for _, file := range result.Files {
+		payload.Files = append(payload.Files, WebhookFile{file.Name, file.Size})
+	}
+	notifyWebhooks(ctx, &payload, options)
+}
+
+// notifyDownload calls the download webhooks once the files are saved. The
+// remaining downloads are those of the file with the fewest left.
+func notifyDownload(ctx context.Context, transferIds []string, files []DecryptFileResult, options *Options) {
+	payload := WebhookPayload{
+		Schema:  outputSchemaVersion,
+		Event:   WebhookDownload,
+		Command: "decrypt",
+		Time:    time.Now().UTC(),
+		Files:   make([]WebhookFile, 0),
+	}
+	if len(transferIds) == 1 {
+		payload.TransferId = transferIds[0]
+	} else {
+		payload.TransferIds = transferIds
+	}
+	for i, file := range files {
+		payload.Files = append(payload.Files, WebhookFile{file.Name, file.Size})
+		if i == 0 || file.RemainingDownloads < payload.RemainingDownloads {
+			payload.RemainingDownloads = file.RemainingDownloads
+		}
+	}
+	notifyWebhooks(ctx, &payload, options)
+}
+
+// notifyWebhooks sends the payload to every webhook of its event. A failed
+// webhook is reported, but the transfer it is about succeeded.
+func notifyWebhooks(ctx context.Context, payload *WebhookPayload, options *Options) {
+	for _, webhook := range activeWebhooks(payload.Event, options) {
+		hookPayload := *payload
+		hookPayload.Labels = webhook.Labels
+		if webhook.OmitKey && hookPayload.Link != "" {
+			hookPayload.Link, _, _ = strings.Cut(hookPayload.Link, "#")
+		}
+		hookPayload.KeyOmitted = hookPayload.Link != "" && !strings.Contains(hookPayload.Link, "#")
+		// The address of a webhook is often its secret
+		shown := webhookOrigin(webhook.Url)
+		err := callWebhook(ctx, &webhook, &hookPayload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Webhook %s failed: %s\n", shown, redactError(err))
+			emitEvent("webhook_failed", map[string]interface{}{"url": shown, "error": redactError(err)})
+			continue
+		}
+		emitEvent("webhook_sent", map[string]interface{}{"url": shown})
+	}
+}
+
+// webhookOrigin returns the scheme and host of a webhook address.
+func webhookOrigin(address string) string {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "[invalid url]"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func callWebhook(ctx context.Context, webhook *Webhook, payload *WebhookPayload) error {
+	body, err := webhookBody(webhook, payload)
+	if err != nil {
+		return err
+	}
+	contentType := webhook.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	policy := requestRetryPolicy
+	if webhook.Retries != 0 {
+		policy.MaxAttempts = max(webhook.Retries, 0) + 1
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	_, err = doWithRetry(ctx, "webhook", policy, func(ctx context.Context) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", contentType)
+		for name, value := range webhook.Headers {
+			request.Header.Set(name, value)
+		}
+		return request, nil
+	})
+	return err
+}
+
+func webhookBody(webhook *Webhook, payload *WebhookPayload) ([]byte, error) {
+	text := webhook.Template
+	if webhook.TemplateFile != "" {
+		data, err := os.ReadFile(expandHome(webhook.TemplateFile))
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return json.Marshal(payload)
+	}
+	parsed, err := template.New("webhook").Funcs(webhookFunctions).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := parsed.Execute(&body, payload); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}